@@ -0,0 +1,223 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAmplification is returned when a packet to an unverified address is
+// not sent because it would exceed the address's byte budget.
+var ErrAmplification = errors.New("unverified address over its byte budget")
+
+// verifiedTTL is how long an address stays verified after it answered
+// one of our queries.
+const verifiedTTL = 30 * time.Minute
+
+// AmplificationLimits keeps the node from being used to reflect traffic
+// at third parties, see OptionAmplificationLimits. An address is verified
+// once it answered one of our queries, which a spoofed source cannot do.
+// Until then:
+//
+//   - the bytes we send to it are capped at Ratio times the bytes we
+//     received from it, plus Allowance, over every Window
+//   - its queries are answered, but it is only added to the routing table
+//     after answering a ping
+//
+// Contacts are only learned from responses to our own queries, and at
+// most MaxContactsPerResponse of them are queried per response. A zero
+// Ratio or MaxContactsPerResponse disables the limit.
+type AmplificationLimits struct {
+	Ratio     float64
+	Allowance int
+	Window    time.Duration
+
+	MaxContactsPerResponse int
+}
+
+// DefaultAmplificationLimits are the limits of a node created without
+// OptionAmplificationLimits.
+var DefaultAmplificationLimits = AmplificationLimits{
+	Ratio:                  3,
+	Allowance:              1500,
+	Window:                 time.Minute,
+	MaxContactsPerResponse: 8,
+}
+
+// AmplificationStats reports the state of the reflection defences.
+type AmplificationStats struct {
+	// Verified is the number of verified addresses.
+	Verified int
+	// Dropped counts the packets to unverified addresses over their
+	// byte budget.
+	Dropped uint64
+}
+
+type byteBudget struct {
+	in, out int
+	start   time.Time
+	probed  bool
+}
+
+type amplificationGuard struct {
+	dropped uint64
+
+	limits AmplificationLimits
+
+	mu       sync.Mutex
+	verified map[string]time.Time
+	budgets  map[string]*byteBudget
+	swept    time.Time
+}
+
+func newAmplificationGuard(limits AmplificationLimits) *amplificationGuard {
+	if limits.Window <= 0 {
+		limits.Window = DefaultAmplificationLimits.Window
+	}
+	return &amplificationGuard{
+		limits:   limits,
+		verified: make(map[string]time.Time),
+		budgets:  make(map[string]*byteBudget),
+	}
+}
+
+// budget returns the byte counters of an unverified ip, restarting them
+// once the window is over, or nil if maxBuckets addresses already have
+// one. It must be called with g.mu held.
+func (g *amplificationGuard) budget(ip net.IP, now time.Time) *byteBudget {
+	if now.Sub(g.swept) > g.limits.Window {
+		g.sweep(now)
+	}
+
+	key := ipKey(ip)
+	b, ok := g.budgets[key]
+	if ok && now.Sub(b.start) <= g.limits.Window {
+		return b
+	}
+	if !ok && len(g.budgets) >= maxBuckets && now.Sub(g.swept) > time.Second {
+		g.sweep(now)
+	}
+	if !ok && len(g.budgets) >= maxBuckets {
+		return nil
+	}
+	b = &byteBudget{start: now}
+	g.budgets[key] = b
+	return b
+}
+
+func (g *amplificationGuard) sweep(now time.Time) {
+	for key, b := range g.budgets {
+		if now.Sub(b.start) > g.limits.Window {
+			delete(g.budgets, key)
+		}
+	}
+	for key, until := range g.verified {
+		if now.After(until) {
+			delete(g.verified, key)
+		}
+	}
+	g.swept = now
+}
+
+// verifiedLocked must be called with g.mu held.
+func (g *amplificationGuard) verifiedLocked(ip net.IP, now time.Time) bool {
+	until, ok := g.verified[ipKey(ip)]
+	return ok && now.Before(until)
+}
+
+func (g *amplificationGuard) verify(ip net.IP) {
+	now := time.Now()
+
+	g.mu.Lock()
+	g.verified[ipKey(ip)] = now.Add(verifiedTTL)
+	delete(g.budgets, ipKey(ip))
+	g.mu.Unlock()
+}
+
+func (g *amplificationGuard) isVerified(ip net.IP) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.verifiedLocked(ip, time.Now())
+}
+
+// received accounts n bytes received from ip.
+func (g *amplificationGuard) received(ip net.IP, n int) {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.verifiedLocked(ip, now) {
+		return
+	}
+	if b := g.budget(ip, now); b != nil {
+		b.in += n
+	}
+}
+
+// allowSend reports whether n more bytes can be sent to ip, and accounts
+// them if so.
+func (g *amplificationGuard) allowSend(ip net.IP, n int) bool {
+	if g.limits.Ratio <= 0 {
+		return true
+	}
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.verifiedLocked(ip, now) {
+		return true
+	}
+	b := g.budget(ip, now)
+	if b == nil || float64(b.out+n) > g.limits.Ratio*float64(b.in)+float64(g.limits.Allowance) {
+		atomic.AddUint64(&g.dropped, 1)
+		return false
+	}
+	b.out += n
+	return true
+}
+
+// probe reports whether an unverified ip should be pinged to verify it,
+// which is done at most once per window.
+func (g *amplificationGuard) probe(ip net.IP) bool {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.verifiedLocked(ip, now) {
+		return false
+	}
+	b := g.budget(ip, now)
+	if b == nil || b.probed {
+		return false
+	}
+	b.probed = true
+	return true
+}
+
+func (g *amplificationGuard) stats() AmplificationStats {
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var verified int
+	for _, until := range g.verified {
+		if now.Before(until) {
+			verified++
+		}
+	}
+	return AmplificationStats{
+		Verified: verified,
+		Dropped:  atomic.LoadUint64(&g.dropped),
+	}
+}
+
+// AmplificationStats returns the number of verified addresses and of the
+// packets dropped to protect unverified ones.
+func (node *Node) AmplificationStats() AmplificationStats {
+	return node.guard.stats()
+}
@@ -0,0 +1,104 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAmplificationBudget(t *testing.T) {
+	g := newAmplificationGuard(AmplificationLimits{Ratio: 2, Allowance: 100, Window: time.Minute})
+	victim := net.IPv4(1, 2, 3, 4)
+
+	if !g.allowSend(victim, 100) {
+		t.Fatal("allowance was not granted")
+	}
+	if g.allowSend(victim, 1) {
+		t.Fatal("sent more than the allowance to a silent address")
+	}
+
+	g.received(victim, 50)
+	if !g.allowSend(victim, 100) || g.allowSend(victim, 1) {
+		t.Error("budget is not twice the received bytes")
+	}
+
+	if !g.probe(victim) || g.probe(victim) {
+		t.Error("address was not probed exactly once")
+	}
+
+	g.verify(victim)
+	if !g.allowSend(victim, 10000) {
+		t.Error("verified address is limited")
+	}
+	if stats := g.stats(); stats.Verified != 1 || stats.Dropped != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAmplificationBudgetCapacity(t *testing.T) {
+	g := newAmplificationGuard(AmplificationLimits{Ratio: 2, Allowance: 100, Window: time.Minute})
+	for i := 0; i < maxBuckets; i++ {
+		g.received(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), 10)
+	}
+	if len(g.budgets) != maxBuckets {
+		t.Fatalf("%d budgets, want %d", len(g.budgets), maxBuckets)
+	}
+
+	spoofed := net.IPv4(1, 2, 3, 4)
+	if g.allowSend(spoofed, 1) {
+		t.Error("new address granted an allowance with the budgets full")
+	}
+	if len(g.budgets) != maxBuckets {
+		t.Errorf("%d budgets after a new address, want %d", len(g.budgets), maxBuckets)
+	}
+}
+
+func TestSpoofedQueriesNotStored(t *testing.T) {
+	node := newTestNode(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	ping, err := (&KRPCQuery{T: []byte("aa"), Q: PingType, NID: id}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(ping, node.LocalAddr())
+
+	// the node pings back; a spoofed source would never see it
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var probe *KRPCMessage
+	for probe == nil {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no verification ping received:", err)
+		}
+		if msg, err := NewKRPCMessage(buf[:n]); err == nil && msg.IsQuery() {
+			probe = msg
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if len(node.Contacts()) != 0 {
+		t.Fatal("unverified source was added to the routing table")
+	}
+
+	resp, err := (&KRPCResponse{T: []byte(probe.T), Q: PingType, QueriedID: id}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(resp, node.LocalAddr())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(node.Contacts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(node.Contacts()) != 1 {
+		t.Error("verified source was not added to the routing table")
+	}
+}
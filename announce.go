@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/bttown/routing-table"
+)
+
+// ErrNoNodes is returned by Announce when no node answered the lookup.
+var ErrNoNodes = errors.New("no node answered the lookup")
+
+const (
+	// announceTimeout bounds the lookup of an Announce.
+	announceTimeout = 30 * time.Second
+	// lookupK is the number of closest nodes a lookup converges to, and
+	// lookupAlpha the number of queries it has in flight.
+	lookupK     = 8
+	lookupAlpha = 3
+	// lookupQueryTimeout is how long a lookup waits for each answer, and
+	// Announce for the answer to each announce_peer.
+	lookupQueryTimeout = 5 * time.Second
+)
+
+// lookupNode is a node met during a lookup.
+type lookupNode struct {
+	info     NodeInfo
+	queried  bool
+	answered bool
+	failed   bool
+	token    string
+}
+
+type lookupReply struct {
+	n   *lookupNode
+	r   *KRPCResponse
+	err error
+}
+
+// lookup walks the DHT towards infoHash with get_peers queries, starting
+// from the closest contacts of the routing table and asking the closest
+// nodes learned so far, until the lookupK closest ones answered or failed.
+// It returns the nodes that answered, closest first, with their tokens.
+func (node *Node) lookup(ctx context.Context, infoHash []byte) []*lookupNode {
+	var target table.Hash
+	copy(target[:], infoHash)
+
+	seen := make(map[string]bool)
+	var nodes []*lookupNode
+	add := func(info NodeInfo) {
+		key := info.UDPAddr.String()
+		if seen[key] || node.blocked(&info.UDPAddr) || node.scores.banned(info.IP) {
+			return
+		}
+		seen[key] = true
+		nodes = append(nodes, &lookupNode{info: info})
+	}
+	for _, contact := range node.table.Closest(target, lookupK).Entries() {
+		add(NodeInfo{ID: NodeID(contact.NID), UDPAddr: contact.UDPAddr})
+	}
+
+	replies := make(chan lookupReply)
+	inflight := 0
+	for {
+		sort.Slice(nodes, func(i, j int) bool {
+			return closer(nodes[i].info.ID, nodes[j].info.ID, target[:])
+		})
+
+		// query the closest nodes not asked yet, among the lookupK closest
+		// that did not fail
+		closest := 0
+		for _, n := range nodes {
+			if closest == lookupK || inflight == lookupAlpha || ctx.Err() != nil {
+				break
+			}
+			if n.failed {
+				continue
+			}
+			closest++
+			if n.queried {
+				continue
+			}
+			n.queried = true
+			inflight++
+			go func(n *lookupNode) {
+				qctx, cancel := context.WithTimeout(ctx, lookupQueryTimeout)
+				defer cancel()
+				r, err := node.Call(qctx, &n.info.UDPAddr, &KRPCQuery{Q: GetPeersType, InfoHash: infoHash})
+				replies <- lookupReply{n: n, r: r, err: err}
+			}(n)
+		}
+		if inflight == 0 {
+			break
+		}
+
+		reply := <-replies
+		inflight--
+		if reply.err != nil {
+			reply.n.failed = true
+			continue
+		}
+		reply.n.answered = true
+		reply.n.token = reply.r.Token
+		for _, info := range reply.r.Nodes {
+			add(*info)
+		}
+	}
+
+	var answered []*lookupNode
+	for _, n := range nodes {
+		if n.answered && len(answered) < lookupK {
+			answered = append(answered, n)
+		}
+	}
+	return answered
+}
+
+// Announce announces that we are a peer for infoHash listening on TCP port
+// to the nodes closest to it in the DHT. It looks them up with get_peers
+// queries, starting from the routing table, and sends an announce_peer
+// with the returned token to the closest ones. It blocks until they
+// answered, at most 35 seconds. The KRPC errors they answer with, such as
+// KRPCErrProtocol for a token they refused, are returned joined; other
+// failures, such as timeouts, only when no announce succeeded. Call it
+// periodically, announces expire on remote nodes.
+func (node *Node) Announce(infoHash []byte, port int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+
+	closest := node.lookup(ctx, infoHash)
+	if len(closest) == 0 {
+		return ErrNoNodes
+	}
+
+	errs := make(chan error, len(closest))
+	sent := 0
+	for _, n := range closest {
+		if n.token == "" {
+			continue
+		}
+		sent++
+		go func(n *lookupNode) {
+			qctx, cancel := context.WithTimeout(context.Background(), lookupQueryTimeout)
+			defer cancel()
+			_, err := node.Call(qctx, &n.info.UDPAddr, &KRPCQuery{
+				Q:        AnnouncePeerType,
+				InfoHash: infoHash,
+				Token:    n.token,
+				Port:     port,
+			})
+			errs <- err
+		}(n)
+	}
+
+	var refused, failed []error
+	for i := 0; i < sent; i++ {
+		err := <-errs
+		var krpcErr *KRPCError
+		if errors.As(err, &krpcErr) {
+			refused = append(refused, err)
+		} else if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(refused)+len(failed) == sent {
+		return errors.Join(append(refused, failed...)...)
+	}
+	return errors.Join(refused...)
+}
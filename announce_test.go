@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bttown/routing-table"
+)
+
+// fakeNode answers get_peers with its token and nodes, and announce_peer
+// with its ID, reporting the tokens of the announces it receives.
+type fakeNode struct {
+	id        NodeID
+	conn      net.PacketConn
+	token     string
+	nodes     []*NodeInfo
+	announces chan string
+}
+
+func newFakeNode(t *testing.T, id NodeID, token string, nodes ...*NodeInfo) *fakeNode {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	f := &fakeNode{id: id, conn: conn, token: token, nodes: nodes, announces: make(chan string, 1)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeNode) info() *NodeInfo {
+	return &NodeInfo{ID: f.id, UDPAddr: *f.conn.LocalAddr().(*net.UDPAddr)}
+}
+
+func (f *fakeNode) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg, err := NewKRPCMessage(buf[:n])
+		if err != nil || !msg.IsQuery() {
+			continue
+		}
+		query := new(KRPCQuery)
+		query.Loads(msg.data)
+
+		switch query.Q {
+		case GetPeersType:
+			resp, _ := (&KRPCResponse{T: query.T, Q: GetPeersType, QueriedID: f.id, Token: f.token, Nodes: f.nodes}).Encode()
+			f.conn.WriteTo(resp, from)
+		case AnnouncePeerType:
+			resp, _ := (&KRPCResponse{T: query.T, Q: AnnouncePeerType, QueriedID: f.id}).Encode()
+			f.conn.WriteTo(resp, from)
+			select {
+			case f.announces <- query.Token:
+			default:
+			}
+		}
+	}
+}
+
+func TestAnnounceLooksUpClosestNodes(t *testing.T) {
+	infoHash := GenerateNodeID()
+	near := infoHash
+	near[19] ^= 1
+
+	closest := newFakeNode(t, near, "near")
+	far := newFakeNode(t, GenerateNodeID(), "far", closest.info())
+
+	node := newTestNode(t)
+	node.table.Update(&table.Contact{UDPAddr: far.info().UDPAddr, NID: table.Hash(far.id)})
+
+	if err := node.Announce(infoHash[:], 6881); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*fakeNode{closest, far} {
+		select {
+		case token := <-f.announces:
+			if token != f.token {
+				t.Errorf("announced with token %q, want %q", token, f.token)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("no announce_peer received by the node with token %q", f.token)
+		}
+	}
+}
+
+func TestAnnounceWithoutNodes(t *testing.T) {
+	node := newTestNode(t)
+	if err := node.Announce(make([]byte, 20), 6881); err != ErrNoNodes {
+		t.Errorf("got %v with an empty routing table, want ErrNoNodes", err)
+	}
+}
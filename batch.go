@@ -0,0 +1,25 @@
+package dht
+
+import (
+	"net"
+)
+
+// defaultBatchSize is the number of datagrams read or written per system
+// call by OptionBatchIO when no size is given.
+const defaultBatchSize = 64
+
+// setSocketBuffers sets the kernel buffer sizes of conn, zero keeps the
+// system default.
+func setSocketBuffers(conn *net.UDPConn, read, write int) error {
+	if read > 0 {
+		if err := conn.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := conn.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
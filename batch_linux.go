@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+package dht
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchIO is implemented by both ipv4.PacketConn and ipv6.PacketConn,
+// which share the Message type.
+type batchIO interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type outgoing struct {
+	b    []byte
+	addr net.Addr
+}
+
+// batchConn is a net.PacketConn that reads and writes up to size
+// datagrams per system call with recvmmsg and sendmmsg. ReadFrom serves
+// datagrams from the last batch read; WriteTo queues the datagram and
+// returns, a single writer flushes the queue in batches. Write deadlines
+// apply to the flushing system calls.
+type batchConn struct {
+	*net.UDPConn
+	batch  batchIO
+	size   int
+	logger Logger
+
+	readMu sync.Mutex
+	read   []ipv4.Message
+	next   int
+	count  int
+
+	writes    chan outgoing
+	closed    chan struct{}
+	closeOnce sync.Once
+	flushed   sync.WaitGroup
+}
+
+func newBatchConn(conn *net.UDPConn, size int, logger Logger) net.PacketConn {
+	if size <= 1 {
+		return conn
+	}
+
+	var batch batchIO = ipv4.NewPacketConn(conn)
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && len(addr.IP) == net.IPv6len {
+		batch = ipv6.NewPacketConn(conn)
+	}
+
+	c := &batchConn{
+		UDPConn: conn,
+		batch:   batch,
+		size:    size,
+		logger:  logger,
+		read:    make([]ipv4.Message, size),
+		writes:  make(chan outgoing, 4*size),
+		closed:  make(chan struct{}),
+	}
+	for i := range c.read {
+		c.read[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+	}
+
+	c.flushed.Add(1)
+	go c.flushLoop()
+	return c
+}
+
+// ReadFrom implements net.PacketConn.
+func (c *batchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if c.next == c.count {
+		n, err := c.batch.ReadBatch(c.read, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.next, c.count = 0, n
+	}
+
+	msg := &c.read[c.next]
+	c.next++
+	return copy(b, msg.Buffers[0][:msg.N]), msg.Addr, nil
+}
+
+// WriteTo implements net.PacketConn. It only blocks when the write queue
+// is full; errors of the system call are logged. Once the conn is closed
+// it fails with net.ErrClosed, like a socket.
+func (c *batchConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	out := outgoing{b: append([]byte(nil), b...), addr: addr}
+	select {
+	case <-c.closed:
+		return 0, c.errClosed(addr)
+	default:
+	}
+	select {
+	case c.writes <- out:
+		return len(b), nil
+	case <-c.closed:
+		return 0, c.errClosed(addr)
+	}
+}
+
+// errClosed is the error of a write to addr on the closed conn.
+func (c *batchConn) errClosed(addr net.Addr) error {
+	return &net.OpError{Op: "write", Net: "udp", Source: c.LocalAddr(), Addr: addr, Err: net.ErrClosed}
+}
+
+func (c *batchConn) flushLoop() {
+	defer c.flushed.Done()
+
+	msgs := make([]ipv4.Message, 0, c.size)
+	for {
+		msgs = msgs[:0]
+		select {
+		case out := <-c.writes:
+			msgs = append(msgs, ipv4.Message{Buffers: [][]byte{out.b}, Addr: out.addr})
+		case <-c.closed:
+			return
+		}
+
+	drain:
+		for len(msgs) < c.size {
+			select {
+			case out := <-c.writes:
+				msgs = append(msgs, ipv4.Message{Buffers: [][]byte{out.b}, Addr: out.addr})
+			default:
+				break drain
+			}
+		}
+
+		for sent := 0; sent < len(msgs); {
+			n, err := c.batch.WriteBatch(msgs[sent:], 0)
+			if err != nil {
+				c.logger.Debug("write batch", "local", c.LocalAddr(), "err", err)
+				if n == 0 {
+					// skip the datagram the kernel refused
+					n = 1
+				}
+			}
+			sent += n
+		}
+	}
+}
+
+// Close implements net.PacketConn. Queued datagrams are dropped.
+func (c *batchConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	err := c.UDPConn.Close()
+	c.flushed.Wait()
+	return err
+}
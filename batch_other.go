@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package dht
+
+import (
+	"net"
+)
+
+// newBatchConn returns conn as is, batched I/O is only implemented on
+// Linux.
+func newBatchConn(conn *net.UDPConn, size int, logger Logger) net.PacketConn {
+	return conn
+}
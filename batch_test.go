@@ -0,0 +1,118 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenLoopback(t testing.TB, batch int) net.PacketConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setSocketBuffers(conn, 4<<20, 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	return newBatchConn(conn, batch, nopLogger{})
+}
+
+func TestBatchConn(t *testing.T) {
+	a, b := listenLoopback(t, 8), listenLoopback(t, 8)
+	defer a.Close()
+	defer b.Close()
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		if _, err := a.WriteTo([]byte(fmt.Sprintf("packet %d", i)), b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, maxPacketSize)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < count; i++ {
+		n, from, err := b.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("packet %d", i); !bytes.Equal(buf[:n], []byte(want)) {
+			t.Fatalf("got %q, want %q", buf[:n], want)
+		}
+		if from.String() != a.LocalAddr().String() {
+			t.Fatalf("packet from %v, want %v", from, a.LocalAddr())
+		}
+	}
+}
+
+func TestBatchConnClosed(t *testing.T) {
+	a := listenLoopback(t, 8)
+	a.Close()
+	if _, err := a.WriteTo([]byte("x"), a.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v writing to a closed conn, want net.ErrClosed", err)
+	}
+	if _, _, err := a.ReadFrom(make([]byte, 16)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v reading from a closed conn, want net.ErrClosed", err)
+	}
+}
+
+func TestNodeBatchIO(t *testing.T) {
+	node := newTestNode(t, OptionBatchIO(0))
+	peer := newTestNode(t)
+
+	if err := node.Ping(peer.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(node.Contacts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(node.Contacts()) == 0 {
+		t.Error("ping response was not received through the batched socket")
+	}
+}
+
+// benchmarkLoopback sends b.N datagrams between two loopback sockets
+// and reports the share lost when the receiver falls behind.
+func benchmarkLoopback(b *testing.B, batch int) {
+	src, dst := listenLoopback(b, batch), listenLoopback(b, batch)
+	defer src.Close()
+	defer dst.Close()
+
+	payload := bytes.Repeat([]byte{'x'}, 300)
+	received := make(chan int)
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		var n int
+		for n < b.N {
+			dst.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, _, err := dst.ReadFrom(buf); err != nil {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		src.WriteTo(payload, dst.LocalAddr())
+	}
+	n := <-received
+	b.StopTimer()
+
+	b.ReportMetric(100*float64(b.N-n)/float64(b.N), "%lost")
+}
+
+func BenchmarkLoopbackSingle(b *testing.B) {
+	benchmarkLoopback(b, 1)
+}
+
+func BenchmarkLoopbackBatch(b *testing.B) {
+	benchmarkLoopback(b, defaultBatchSize)
+}
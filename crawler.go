@@ -0,0 +1,449 @@
+package dht
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CrawlerConfig configures the crawler that sends find_node to the
+// contacts learned from responses, see OptionCrawler.
+type CrawlerConfig struct {
+	// Rate is the target number of find_node queries per second.
+	Rate float64
+	// QueueSize is the number of contacts waiting to be queried; more
+	// are dropped.
+	QueueSize int
+	// VisitedTTL is how long a queried address is not queried again.
+	// Addresses are forgotten after VisitedTTL/2 to VisitedTTL.
+	VisitedTTL time.Duration
+	// VisitedCapacity is the number of addresses the visited set holds
+	// per VisitedTTL/2 with a false positive rate of about 1%.
+	VisitedCapacity int
+	// MaxTimeoutRatio is the share of unanswered queries above which the
+	// crawler slows down. It speeds up again when fewer time out.
+	MaxTimeoutRatio float64
+	// Strategy picks the targets of the queries.
+	Strategy CrawlStrategy
+	// NeighborRotation, when positive, makes the crawler present itself
+	// as a neighbor of a region of the keyspace instead of with the node
+	// ID, moving to the least covered region every NeighborRotation.
+	// Remotes store us in their closest buckets of that region, and send
+	// us the announces for it.
+	NeighborRotation time.Duration
+}
+
+// CrawlStrategy picks the targets of the crawler's find_node queries.
+type CrawlStrategy int
+
+const (
+	// CrawlRandom picks uniformly random targets.
+	CrawlRandom CrawlStrategy = iota
+	// CrawlCoverage picks targets in the ID prefixes where the fewest
+	// nodes answered, to reach the whole keyspace evenly.
+	CrawlCoverage
+)
+
+// DefaultCrawlerConfig is the configuration of a node created without
+// OptionCrawler.
+var DefaultCrawlerConfig = CrawlerConfig{
+	Rate:            500,
+	QueueSize:       4096,
+	VisitedTTL:      10 * time.Minute,
+	VisitedCapacity: 1 << 18,
+	MaxTimeoutRatio: 0.75,
+	Strategy:        CrawlCoverage,
+}
+
+const (
+	// crawlAdjustInterval is how often the rate is adapted to timeouts.
+	crawlAdjustInterval = 5 * time.Second
+	// minCrawlSamples is the number of queries needed to adapt the rate.
+	minCrawlSamples = 20
+	// minCrawlFactor is the lowest share of the target rate.
+	minCrawlFactor = 0.05
+	// coverageDepth is the length in bits of the ID prefixes whose nodes
+	// are counted.
+	coverageDepth = 16
+)
+
+// CrawlerStats reports the activity of the crawler.
+type CrawlerStats struct {
+	// Rate is the current rate in queries per second, lower than the
+	// target when many queries time out.
+	Rate float64
+	// Queued is the number of contacts waiting to be queried.
+	Queued int
+	// Sent counts the queries sent and Answered the find_node responses.
+	Sent     uint64
+	Answered uint64
+	// Duplicates counts contacts skipped because they were visited
+	// recently, Dropped those that did not fit in the queue.
+	Duplicates uint64
+	Dropped    uint64
+	// UniquePerMinute is the number of new contacts seen during the last
+	// full minute.
+	UniquePerMinute int
+	// Coverage[d] is the share of the ID prefixes of d bits, for d up to
+	// 16, in which at least one node answered a find_node.
+	Coverage []float64
+}
+
+// bloom is a bloom filter of strings.
+type bloom struct {
+	bits []uint64
+	k    uint64
+}
+
+func newBloom(n int, p float64) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloom{bits: make([]uint64, (m+63)/64), k: k}
+}
+
+// positions derives the bit positions of key by double hashing.
+func (b *bloom) positions(key string, f func(word, bit uint64) bool) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.k; i++ {
+		pos := (h1 + i*h2) % m
+		if !f(pos/64, pos%64) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(key string) {
+	b.positions(key, func(word, bit uint64) bool {
+		b.bits[word] |= 1 << bit
+		return true
+	})
+}
+
+func (b *bloom) has(key string) bool {
+	return b.positions(key, func(word, bit uint64) bool {
+		return b.bits[word]&(1<<bit) != 0
+	})
+}
+
+// visitedSet is a time decayed set made of two bloom filters: new keys go
+// to the current one, which replaces the previous one every ttl/2.
+type visitedSet struct {
+	mu       sync.Mutex
+	cur      *bloom
+	prev     *bloom
+	capacity int
+	ttl      time.Duration
+	rotated  time.Time
+}
+
+func newVisitedSet(capacity int, ttl time.Duration) *visitedSet {
+	return &visitedSet{
+		cur:      newBloom(capacity, 0.01),
+		prev:     newBloom(capacity, 0.01),
+		capacity: capacity,
+		ttl:      ttl,
+		rotated:  time.Now(),
+	}
+}
+
+// visit adds key to the set and reports whether it was already in it.
+func (v *visitedSet) visit(key string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.rotated) >= v.ttl/2 {
+		v.prev = v.cur
+		v.cur = newBloom(v.capacity, 0.01)
+		v.rotated = now
+	}
+
+	if v.cur.has(key) {
+		return true
+	}
+	v.cur.add(key)
+	return v.prev.has(key)
+}
+
+// coverage counts the nodes that answered per ID prefix.
+type coverage struct {
+	mu     sync.Mutex
+	counts []uint32
+}
+
+func newCoverage() *coverage {
+	return &coverage{counts: make([]uint32, 1<<coverageDepth)}
+}
+
+func idPrefix(id []byte) int {
+	return int(binary.BigEndian.Uint16(id))
+}
+
+func (cv *coverage) add(id NodeID) {
+	cv.mu.Lock()
+	cv.counts[idPrefix(id[:])]++
+	cv.mu.Unlock()
+}
+
+// target returns a random ID in the least covered of a few random
+// prefixes. Sampling keeps it cheap, and spreads the targets over all the
+// prefixes covered least instead of hammering the first of them.
+func (cv *coverage) target() NodeID {
+	id := GenerateNodeID()
+	candidates := generateBytes()
+
+	cv.mu.Lock()
+	best := idPrefix(id[:])
+	for i := 0; i+1 < len(candidates); i += 2 {
+		if p := idPrefix(candidates[i:]); cv.counts[p] < cv.counts[best] {
+			best = p
+		}
+	}
+	cv.mu.Unlock()
+
+	binary.BigEndian.PutUint16(id[:], uint16(best))
+	return id
+}
+
+// shares returns the share of covered prefixes for every depth.
+func (cv *coverage) shares() []float64 {
+	covered := make([]bool, len(cv.counts))
+	cv.mu.Lock()
+	for i, n := range cv.counts {
+		covered[i] = n > 0
+	}
+	cv.mu.Unlock()
+
+	shares := make([]float64, coverageDepth+1)
+	for depth := coverageDepth; depth >= 0; depth-- {
+		n := 0
+		for _, c := range covered {
+			if c {
+				n++
+			}
+		}
+		shares[depth] = float64(n) / float64(len(covered))
+
+		// fold the prefixes into those one bit shorter
+		for i := 0; i < len(covered)/2; i++ {
+			covered[i] = covered[2*i] || covered[2*i+1]
+		}
+		covered = covered[:len(covered)/2]
+	}
+	return shares
+}
+
+type crawler struct {
+	sent, answered, duplicates, dropped uint64
+
+	config   CrawlerConfig
+	queue    chan *NodeInfo
+	visited  *visitedSet
+	coverage *coverage
+
+	mu         sync.Mutex
+	region     NodeID
+	rotated    time.Time
+	factor     float64
+	windowSent uint64
+	windowAns  uint64
+	unique     int
+	lastUnique int
+	minute     time.Time
+}
+
+func newCrawler(config CrawlerConfig) *crawler {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultCrawlerConfig.QueueSize
+	}
+	if config.VisitedTTL <= 0 {
+		config.VisitedTTL = DefaultCrawlerConfig.VisitedTTL
+	}
+	if config.VisitedCapacity <= 0 {
+		config.VisitedCapacity = DefaultCrawlerConfig.VisitedCapacity
+	}
+	return &crawler{
+		config:   config,
+		queue:    make(chan *NodeInfo, config.QueueSize),
+		visited:  newVisitedSet(config.VisitedCapacity, config.VisitedTTL),
+		coverage: newCoverage(),
+		factor:   1,
+		minute:   time.Now(),
+	}
+}
+
+// offer queues a contact learned from a response unless it was visited
+// recently. It never blocks.
+func (c *crawler) offer(info *NodeInfo) {
+	now := time.Now()
+	if c.visited.visit(info.UDPAddr.String(), now) {
+		atomic.AddUint64(&c.duplicates, 1)
+		return
+	}
+
+	c.mu.Lock()
+	if now.Sub(c.minute) >= time.Minute {
+		c.lastUnique, c.unique = c.unique, 0
+		c.minute = now
+	}
+	c.unique++
+	c.mu.Unlock()
+
+	select {
+	case c.queue <- info:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// onAnswer counts a find_node response from the node id, crawled if it
+// answers a query of the crawler.
+func (c *crawler) onAnswer(id NodeID, crawled bool) {
+	if crawled {
+		atomic.AddUint64(&c.answered, 1)
+	}
+	if id != (NodeID{}) {
+		c.coverage.add(id)
+	}
+}
+
+// target returns the target of the next query.
+func (c *crawler) target() NodeID {
+	if c.config.Strategy == CrawlCoverage {
+		return c.coverage.target()
+	}
+	return GenerateNodeID()
+}
+
+// identity returns the ID presented in the next query: own, or a
+// neighbor of the current region with NeighborRotation.
+func (c *crawler) identity(own NodeID, now time.Time) NodeID {
+	if c.config.NeighborRotation <= 0 {
+		return own
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rotated.IsZero() || now.Sub(c.rotated) >= c.config.NeighborRotation {
+		c.region = c.coverage.target()
+		c.rotated = now
+	}
+	return GetNeighborNID(own, c.region[:])
+}
+
+// rate returns the current rate in queries per second.
+func (c *crawler) rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config.Rate * c.factor
+}
+
+// adjust slows down multiplicatively when too many of the queries sent
+// since the last call timed out, and speeds up additively otherwise.
+func (c *crawler) adjust() {
+	sent := atomic.LoadUint64(&c.sent)
+	answered := atomic.LoadUint64(&c.answered)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ds, da := sent-c.windowSent, answered-c.windowAns
+	if ds < minCrawlSamples {
+		return
+	}
+	c.windowSent, c.windowAns = sent, answered
+
+	if timeouts := 1 - float64(da)/float64(ds); timeouts > c.config.MaxTimeoutRatio {
+		c.factor = math.Max(c.factor/2, minCrawlFactor)
+	} else {
+		c.factor = math.Min(c.factor+0.1, 1)
+	}
+}
+
+func (c *crawler) stats() CrawlerStats {
+	c.mu.Lock()
+	unique := c.lastUnique
+	switch since := time.Since(c.minute); {
+	case since >= 2*time.Minute:
+		unique = 0
+	case since >= time.Minute:
+		unique = c.unique
+	}
+	c.mu.Unlock()
+
+	return CrawlerStats{
+		Rate:            c.rate(),
+		Queued:          len(c.queue),
+		Sent:            atomic.LoadUint64(&c.sent),
+		Answered:        atomic.LoadUint64(&c.answered),
+		Duplicates:      atomic.LoadUint64(&c.duplicates),
+		Dropped:         atomic.LoadUint64(&c.dropped),
+		UniquePerMinute: unique,
+		Coverage:        c.coverage.shares(),
+	}
+}
+
+// crawl sends find_node to the queued contacts at the crawler's rate until
+// the node is closed.
+func (node *Node) crawl() {
+	c := node.crawler
+	adjust := time.NewTicker(crawlAdjustInterval)
+	defer adjust.Stop()
+
+	next := time.Now()
+	for {
+		select {
+		case <-node.closed:
+			return
+		case <-adjust.C:
+			c.adjust()
+		case info := <-c.queue:
+			if rate := c.rate(); rate > 0 {
+				if d := time.Until(next); d > 0 {
+					select {
+					case <-time.After(d):
+					case <-node.closed:
+						return
+					}
+				}
+				// do not save up for bursts after an idle period
+				if now := time.Now(); next.Before(now) {
+					next = now
+				}
+				next = next.Add(time.Duration(float64(time.Second) / rate))
+			}
+			// the identity closest to the target fills its own table
+			target := c.target()
+			own := node.closestIdentity(target[:])
+			query := &KRPCQuery{
+				T:         node.tokenManager.GenToken(),
+				Q:         FindNodeType,
+				NID:       c.identity(own, time.Now()),
+				TargetNID: target,
+			}
+			// queries dropped before being sent cannot time out
+			if node.send(&info.UDPAddr, query, &transaction{crawl: true}) == nil {
+				atomic.AddUint64(&c.sent, 1)
+			}
+		}
+	}
+}
+
+// CrawlerStats returns the rate and counters of the crawler.
+func (node *Node) CrawlerStats() CrawlerStats {
+	return node.crawler.stats()
+}
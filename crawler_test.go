@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVisitedSet(t *testing.T) {
+	v := newVisitedSet(1000, time.Minute)
+	now := time.Now()
+
+	if v.visit("1.2.3.4:6881", now) {
+		t.Fatal("new address reported as visited")
+	}
+	if !v.visit("1.2.3.4:6881", now.Add(time.Second)) {
+		t.Fatal("address not remembered")
+	}
+	// still known after one rotation, forgotten after two
+	if !v.visit("1.2.3.4:6881", now.Add(40*time.Second)) {
+		t.Error("address forgotten before the ttl")
+	}
+	v.visit("5.6.7.8:6881", now.Add(80*time.Second))
+	if v.visit("1.2.3.4:6881", now.Add(120*time.Second)) {
+		t.Error("address remembered after the ttl")
+	}
+}
+
+func TestBloomFalsePositives(t *testing.T) {
+	b := newBloom(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		b.add(fmt.Sprintf("10.0.%d.%d:1", i/256, i%256))
+	}
+	var fp int
+	for i := 0; i < 1000; i++ {
+		if b.has(fmt.Sprintf("10.1.%d.%d:1", i/256, i%256)) {
+			fp++
+		}
+	}
+	if fp > 50 {
+		t.Errorf("%d false positives in 1000", fp)
+	}
+}
+
+func TestCrawlerOffer(t *testing.T) {
+	c := newCrawler(CrawlerConfig{Rate: 10, QueueSize: 2})
+	for i := 0; i < 4; i++ {
+		c.offer(&NodeInfo{UDPAddr: net.UDPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 6881}})
+	}
+	c.offer(&NodeInfo{UDPAddr: net.UDPAddr{IP: net.IPv4(1, 2, 3, 0), Port: 6881}})
+
+	stats := c.stats()
+	if stats.Queued != 2 || stats.Dropped != 2 || stats.Duplicates != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	c.minute = c.minute.Add(-time.Minute)
+	if stats := c.stats(); stats.UniquePerMinute != 4 {
+		t.Errorf("%d unique nodes per minute, want 4", stats.UniquePerMinute)
+	}
+}
+
+func TestCrawlerSlowsDownOnTimeouts(t *testing.T) {
+	c := newCrawler(CrawlerConfig{Rate: 100, MaxTimeoutRatio: 0.5})
+
+	c.sent += 100
+	c.answered += 10
+	c.adjust()
+	if r := c.rate(); r != 50 {
+		t.Fatalf("rate %v after 90%% timeouts, want 50", r)
+	}
+
+	c.sent += 100
+	c.answered += 80
+	c.adjust()
+	if r := c.rate(); r < 59 || r > 61 {
+		t.Errorf("rate %v after recovering, want 60", r)
+	}
+
+	c.sent += minCrawlSamples - 1
+	c.adjust()
+	if r := c.rate(); r < 59 || r > 61 {
+		t.Errorf("rate changed to %v on too few samples", r)
+	}
+}
+
+func TestCrawlerCountsOwnQueries(t *testing.T) {
+	node := newTestNode(t, OptionRateLimits(RateLimits{
+		Queries: map[QueryType]RateLimit{FindNodeType: {Rate: 0.001, Burst: 1}},
+	}))
+	c := node.crawler
+	for i := 1; i <= 3; i++ {
+		c.offer(&NodeInfo{UDPAddr: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: i}})
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if stats := c.stats(); stats.Sent != 1 {
+		t.Errorf("%d queries counted as sent, want the 1 within the rate limit", stats.Sent)
+	}
+
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	r := &KRPCResponse{Q: FindNodeType, QueriedID: GenerateNodeID()}
+	node.handleResponse(r, &transaction{q: FindNodeType}, remote)
+	if stats := c.stats(); stats.Answered != 0 {
+		t.Errorf("%d answers counted for a query the crawler did not send", stats.Answered)
+	}
+	node.handleResponse(r, &transaction{q: FindNodeType, crawl: true}, remote)
+	if stats := c.stats(); stats.Answered != 1 {
+		t.Errorf("%d answers counted, want 1", stats.Answered)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	cv := newCoverage()
+	for p := 1 << 15; p < 1<<16; p++ {
+		var id NodeID
+		id[0], id[1] = byte(p>>8), byte(p)
+		cv.add(id)
+	}
+
+	shares := cv.shares()
+	if len(shares) != coverageDepth+1 || shares[0] != 1 || shares[1] != 0.5 || shares[coverageDepth] != 0.5 {
+		t.Errorf("unexpected coverage %v", shares)
+	}
+
+	low := 0
+	for i := 0; i < 100; i++ {
+		if id := cv.target(); id[0] < 0x80 {
+			low++
+		}
+	}
+	if low < 90 {
+		t.Errorf("only %d of 100 targets in the uncovered half", low)
+	}
+}
+
+func TestNeighborRotation(t *testing.T) {
+	c := newCrawler(CrawlerConfig{NeighborRotation: time.Minute})
+	own := GenerateNodeID()
+	now := time.Now()
+
+	id := c.identity(own, now)
+	if id == own || string(id[10:]) != string(own[10:]) {
+		t.Fatalf("identity %x is not a neighbor ID of %x", id, own)
+	}
+	if c.identity(own, now.Add(time.Second)) != id {
+		t.Error("identity changed before the rotation")
+	}
+	if c.identity(own, now.Add(time.Minute)) == id {
+		t.Error("identity did not rotate")
+	}
+}
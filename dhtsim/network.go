@@ -0,0 +1,387 @@
+// Package dhtsim runs many DHT nodes in one process over a simulated
+// packet network, with latency, loss, NAT-like reachability rules and
+// partitions, so that lookups, announces and routing table convergence
+// can be tested without touching the real network.
+package dhtsim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrClosed    = errors.New("dhtsim: endpoint closed")
+	ErrAddrInUse = errors.New("dhtsim: address already in use")
+	errTimeout   = &timeoutError{}
+)
+
+const (
+	defaultPort    = 6881
+	inboxSize      = 1024
+	natMappingTime = 2 * time.Minute
+)
+
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "dhtsim: i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
+
+// Config describes the links of the simulated network.
+type Config struct {
+	// Seed makes node IDs, addresses, loss and jitter reproducible.
+	Seed int64
+	// Latency is the one way delay of every packet.
+	Latency time.Duration
+	// Jitter is the maximum random delay added to Latency.
+	Jitter time.Duration
+	// Loss is the probability in [0, 1] that a packet is dropped.
+	Loss float64
+}
+
+// Stats counts packets on the network or an endpoint.
+type Stats struct {
+	Sent      uint64
+	Delivered uint64
+	Dropped   uint64
+}
+
+// Rule decides whether a packet from one address can reach another.
+type Rule func(from, to *net.UDPAddr) bool
+
+type packet struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// Network is an in-memory packet network. The zero value is not usable,
+// create one with NewNetwork.
+type Network struct {
+	cfg Config
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	endpoints  map[string]*Endpoint
+	partitions map[string]int
+	rules      []Rule
+	tap        func(from, to *net.UDPAddr, b []byte)
+	nextIP     uint32
+
+	sent, delivered, dropped uint64
+}
+
+// NewNetwork creates an empty network.
+func NewNetwork(cfg Config) *Network {
+	return &Network{
+		cfg:        cfg,
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+		endpoints:  make(map[string]*Endpoint),
+		partitions: make(map[string]int),
+		nextIP:     10<<24 | 1,
+	}
+}
+
+// Listen creates an endpoint on the next free address of 10.0.0.0/8.
+// Every endpoint gets a /24 of its own, as hosts on the internet mostly
+// do, so that per subnet limits of the nodes do not kick in.
+func (n *Network) Listen() (*Endpoint, error) {
+	n.mu.Lock()
+	ip := n.nextIP
+	n.nextIP += 1 << 8
+	n.mu.Unlock()
+
+	addr := &net.UDPAddr{
+		IP:   net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).To4(),
+		Port: defaultPort,
+	}
+	return n.ListenAddr(addr)
+}
+
+// ListenAddr creates an endpoint on addr.
+func (n *Network) ListenAddr(addr *net.UDPAddr) (*Endpoint, error) {
+	e := &Endpoint{
+		net:      n,
+		addr:     addr,
+		inbox:    make(chan packet, inboxSize),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}),
+		mappings: make(map[string]time.Time),
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.endpoints[addr.String()]; ok {
+		return nil, ErrAddrInUse
+	}
+	n.endpoints[addr.String()] = e
+	return e, nil
+}
+
+// Partition splits the network: packets are only delivered between
+// addresses of the same group. Addresses not listed form one more group.
+func (n *Network) Partition(groups ...[]net.Addr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.partitions[addr.String()] = i + 1
+		}
+	}
+}
+
+// Heal removes every partition.
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+// AddRule adds a reachability rule; a packet is delivered only if every
+// rule allows it.
+func (n *Network) AddRule(rule Rule) {
+	n.mu.Lock()
+	n.rules = append(n.rules, rule)
+	n.mu.Unlock()
+}
+
+// Tap calls f with every packet that is about to be delivered. f must not
+// retain or modify b.
+func (n *Network) Tap(f func(from, to *net.UDPAddr, b []byte)) {
+	n.mu.Lock()
+	n.tap = f
+	n.mu.Unlock()
+}
+
+// Stats returns the packet counters of the whole network.
+func (n *Network) Stats() Stats {
+	return Stats{
+		Sent:      atomic.LoadUint64(&n.sent),
+		Delivered: atomic.LoadUint64(&n.delivered),
+		Dropped:   atomic.LoadUint64(&n.dropped),
+	}
+}
+
+func (n *Network) send(from *Endpoint, b []byte, to *net.UDPAddr) {
+	atomic.AddUint64(&n.sent, 1)
+	atomic.AddUint64(&from.sent, 1)
+
+	n.mu.Lock()
+	dst, ok := n.endpoints[to.String()]
+	drop := !ok ||
+		n.partitions[from.addr.String()] != n.partitions[to.String()] ||
+		(n.cfg.Loss > 0 && n.rand.Float64() < n.cfg.Loss)
+	for _, rule := range n.rules {
+		if drop {
+			break
+		}
+		drop = !rule(from.addr, to)
+	}
+	delay := n.cfg.Latency
+	if n.cfg.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.cfg.Jitter)))
+	}
+	tap := n.tap
+	n.mu.Unlock()
+
+	if drop {
+		atomic.AddUint64(&n.dropped, 1)
+		return
+	}
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	p := packet{b: buf, from: from.addr}
+
+	deliver := func() {
+		if !dst.accepts(from.addr) {
+			atomic.AddUint64(&n.dropped, 1)
+			return
+		}
+		if tap != nil {
+			tap(from.addr, to, buf)
+		}
+		if dst.enqueue(p) {
+			atomic.AddUint64(&n.delivered, 1)
+		} else {
+			atomic.AddUint64(&n.dropped, 1)
+		}
+	}
+
+	if delay <= 0 {
+		deliver()
+		return
+	}
+	time.AfterFunc(delay, deliver)
+}
+
+func (n *Network) remove(e *Endpoint) {
+	n.mu.Lock()
+	if n.endpoints[e.addr.String()] == e {
+		delete(n.endpoints, e.addr.String())
+	}
+	n.mu.Unlock()
+}
+
+// Endpoint is a net.PacketConn attached to a Network.
+type Endpoint struct {
+	sent, received uint64
+
+	net   *Network
+	addr  *net.UDPAddr
+	inbox chan packet
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	deadline     chan struct{}
+	nat          bool
+	mappings     map[string]time.Time
+}
+
+// SetNAT puts the endpoint behind a NAT: it only receives packets from
+// addresses it sent a packet to during the last two minutes.
+func (e *Endpoint) SetNAT(nat bool) {
+	e.mu.Lock()
+	e.nat = nat
+	e.mu.Unlock()
+}
+
+func (e *Endpoint) accepts(from *net.UDPAddr) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.nat {
+		return true
+	}
+	t, ok := e.mappings[from.String()]
+	return ok && time.Since(t) < natMappingTime
+}
+
+func (e *Endpoint) enqueue(p packet) bool {
+	select {
+	case <-e.closed:
+		return false
+	default:
+	}
+
+	select {
+	case e.inbox <- p:
+		atomic.AddUint64(&e.received, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats returns the number of packets sent and received by the endpoint.
+func (e *Endpoint) Stats() (sent, received uint64) {
+	return atomic.LoadUint64(&e.sent), atomic.LoadUint64(&e.received)
+}
+
+// ReadFrom implements net.PacketConn.
+func (e *Endpoint) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		e.mu.Lock()
+		deadline := e.readDeadline
+		changed := e.deadline
+		e.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, errTimeout
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case p := <-e.inbox:
+			stopTimer(timer)
+			return copy(b, p.b), p.from, nil
+		case <-e.closed:
+			stopTimer(timer)
+			return 0, nil, ErrClosed
+		case <-timeout:
+			return 0, nil, errTimeout
+		case <-changed:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// WriteTo implements net.PacketConn. Packets to unknown or unreachable
+// addresses are silently dropped, as on a real network.
+func (e *Endpoint) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-e.closed:
+		return 0, ErrClosed
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		if to, err = net.ResolveUDPAddr("udp", addr.String()); err != nil {
+			return 0, err
+		}
+	}
+
+	e.mu.Lock()
+	if e.nat {
+		e.mappings[to.String()] = time.Now()
+	}
+	e.mu.Unlock()
+
+	e.net.send(e, b, to)
+	return len(b), nil
+}
+
+// Close implements net.PacketConn.
+func (e *Endpoint) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.closed)
+		e.net.remove(e)
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn.
+func (e *Endpoint) LocalAddr() net.Addr {
+	return e.addr
+}
+
+// SetDeadline implements net.PacketConn. Writes never block, so only the
+// read deadline is used.
+func (e *Endpoint) SetDeadline(t time.Time) error {
+	return e.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.PacketConn.
+func (e *Endpoint) SetReadDeadline(t time.Time) error {
+	e.mu.Lock()
+	e.readDeadline = t
+	close(e.deadline)
+	e.deadline = make(chan struct{})
+	e.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements net.PacketConn.
+func (e *Endpoint) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package dhtsim
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bttown/dht"
+)
+
+// Sim is a set of DHT nodes running on a simulated network. The first
+// node started is the bootstrap router of every other node.
+type Sim struct {
+	Network *Network
+
+	mu        sync.Mutex
+	rand      *rand.Rand
+	nodes     []*dht.Node
+	endpoints []*Endpoint
+	routers   []string
+}
+
+// New creates a simulation on a new network configured with cfg.
+func New(cfg Config) *Sim {
+	return &Sim{
+		Network: NewNetwork(cfg),
+		rand:    rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+// crawlerConfig keeps the crawlers of thousands of nodes sharing one
+// process from flooding the network: each sends a few queries a second
+// instead of hundreds, and remembers fewer addresses.
+var crawlerConfig = func() dht.CrawlerConfig {
+	c := dht.DefaultCrawlerConfig
+	c.Rate = 5
+	c.QueueSize = 256
+	c.VisitedCapacity = 1 << 12
+	return c
+}()
+
+// AddNode starts one node on a fresh address. Nodes added after the first
+// one bootstrap from it. opts are applied after the simulation's own
+// options, so they can override them, for example OptionCrawler for a
+// faster crawler than the simulation's one.
+func (s *Sim) AddNode(ctx context.Context, opts ...dht.NodeOption) (*dht.Node, *Endpoint, error) {
+	e, err := s.Network.Listen()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	id := make([]byte, dht.NodeIDBytes)
+	s.rand.Read(id)
+	routers := s.routers
+	if len(routers) == 0 {
+		s.routers = []string{e.LocalAddr().String()}
+	}
+	s.mu.Unlock()
+
+	options := []dht.NodeOption{
+		dht.OptionNodeID(hex.EncodeToString(id)),
+		dht.OptionPacketConn(e),
+		dht.OptionDumpFile(""),
+		dht.OptionRouters(routers...),
+		dht.OptionIPFilter(nil),
+		dht.OptionCrawler(crawlerConfig),
+	}
+	node := dht.NewNode(append(options, opts...)...)
+	if err := node.Start(ctx); err != nil {
+		e.Close()
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	s.nodes = append(s.nodes, node)
+	s.endpoints = append(s.endpoints, e)
+	s.mu.Unlock()
+	return node, e, nil
+}
+
+// Start adds n nodes.
+func (s *Sim) Start(ctx context.Context, n int, opts ...dht.NodeOption) error {
+	for i := 0; i < n; i++ {
+		if _, _, err := s.AddNode(ctx, opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nodes returns the running nodes in the order they were added.
+func (s *Sim) Nodes() []*dht.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*dht.Node(nil), s.nodes...)
+}
+
+// Endpoint returns the network endpoint of node i.
+func (s *Sim) Endpoint(i int) *Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.endpoints[i]
+}
+
+// Addrs returns the addresses of nodes i to j-1, for use with Partition.
+func (s *Sim) Addrs(i, j int) []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, j-i)
+	for _, e := range s.endpoints[i:j] {
+		addrs = append(addrs, e.LocalAddr())
+	}
+	return addrs
+}
+
+// Converged reports the share of nodes, in [0, 1], that have at least
+// minContacts contacts in their routing table.
+func (s *Sim) Converged(minContacts int) float64 {
+	nodes := s.Nodes()
+	if len(nodes) == 0 {
+		return 0
+	}
+
+	var ok int
+	for _, node := range nodes {
+		if len(node.Contacts()) >= minContacts {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(nodes))
+}
+
+// WaitConverged polls Converged until it reaches share or ctx is done.
+func (s *Sim) WaitConverged(ctx context.Context, minContacts int, share float64) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if s.Converged(minContacts) >= share {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stops every node and closes their endpoints.
+func (s *Sim) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	nodes, endpoints := s.nodes, s.endpoints
+	s.nodes, s.endpoints = nil, nil
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(nodes))
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *dht.Node) {
+			defer wg.Done()
+			if err := node.Shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	for _, e := range endpoints {
+		e.Close()
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,193 @@
+package dhtsim
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bttown/dht"
+)
+
+func TestConvergence(t *testing.T) {
+	sim := New(Config{Seed: 1, Latency: 2 * time.Millisecond, Jitter: 3 * time.Millisecond, Loss: 0.01})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	defer sim.Shutdown(context.Background())
+
+	if err := sim.Start(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.WaitConverged(ctx, 1, 0.95); err != nil {
+		t.Fatalf("only %.2f of the nodes know a contact", sim.Converged(1))
+	}
+
+	// the router is the only contact a node starts with, the others come
+	// from find_node responses
+	if err := sim.WaitConverged(ctx, 8, 0.9); err != nil {
+		t.Fatalf("only %.2f of the nodes know 8 contacts", sim.Converged(8))
+	}
+
+	stats := sim.Network.Stats()
+	if stats.Dropped == 0 || stats.Delivered == 0 {
+		t.Errorf("unexpected network stats %+v", stats)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	sim := New(Config{Seed: 2})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	defer sim.Shutdown(context.Background())
+
+	if err := sim.Start(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	sim.Network.Partition(sim.Addrs(0, 1))
+	if err := sim.Start(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * time.Second)
+	if c := sim.Converged(1); c != 0 {
+		t.Fatalf("%.2f of the nodes reached the router across the partition", c)
+	}
+
+	sim.Network.Heal()
+	if err := sim.WaitConverged(ctx, 1, 0.9); err != nil {
+		t.Fatalf("nodes did not converge after healing: %.2f", sim.Converged(1))
+	}
+}
+
+func TestNAT(t *testing.T) {
+	sim := New(Config{Seed: 3})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	defer sim.Shutdown(context.Background())
+
+	if err := sim.Start(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	natted, e, err := sim.AddNode(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetNAT(true)
+
+	stranger := sim.Nodes()[1]
+	var fromStranger int64
+	sim.Network.Tap(func(from, to *net.UDPAddr, b []byte) {
+		if to.String() == e.LocalAddr().String() && from.String() == stranger.LocalAddr().String() {
+			atomic.AddInt64(&fromStranger, 1)
+		}
+	})
+
+	// the node behind NAT only queries the router for its first two
+	// seconds, once the router told it about the stranger it may contact
+	// it and get answers
+	pingCtx, cancelPing := context.WithTimeout(ctx, 500*time.Millisecond)
+	_, err = stranger.Call(pingCtx, e.LocalAddr().(*net.UDPAddr), &dht.KRPCQuery{Q: dht.PingType})
+	cancelPing()
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v pinging the node behind NAT, want no answer", err)
+	}
+	if n := atomic.LoadInt64(&fromStranger); n != 0 {
+		t.Errorf("%d unsolicited packets crossed the NAT", n)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(natted.Contacts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(natted.Contacts()) == 0 {
+		t.Error("node behind NAT could not reach the router")
+	}
+}
+
+func TestDeterministicSeed(t *testing.T) {
+	ids := func() []string {
+		sim := New(Config{Seed: 42})
+		defer sim.Shutdown(context.Background())
+		if err := sim.Start(context.Background(), 5); err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, node := range sim.Nodes() {
+			ids = append(ids, node.GetStringID()+node.LocalAddr().String())
+		}
+		return ids
+	}
+
+	a, b := ids(), ids()
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("node %d differs between runs with the same seed: %s != %s", i, a[i], b[i])
+		}
+	}
+}
+
+func TestAnnounceReachesClosestNodes(t *testing.T) {
+	sim := New(Config{Seed: 4, Latency: time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	defer sim.Shutdown(context.Background())
+
+	const n = 60
+	announced := make([]int32, n)
+	for i := 0; i < n; i++ {
+		i := i
+		handler := dht.PeerHandlerFunc(func(ip string, port int, infoHash, peerID string) {
+			atomic.StoreInt32(&announced[i], 1)
+		})
+		if _, _, err := sim.AddNode(ctx, dht.OptionEventHandler(handler)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sim.WaitConverged(ctx, 8, 0.9); err != nil {
+		t.Fatalf("only %.2f of the nodes know 8 contacts", sim.Converged(8))
+	}
+
+	infoHash := make([]byte, dht.NodeIDBytes)
+	rand.New(rand.NewSource(4)).Read(infoHash)
+	nodes := sim.Nodes()
+	announcer := nodes[n-1]
+	if err := announcer.Announce(infoHash, 6881); err != nil {
+		t.Fatal(err)
+	}
+
+	// the nodes closest to the infohash, the announcer left out
+	order := make([]int, n-1)
+	for i := range order {
+		order[i] = i
+	}
+	distance := func(i int) []byte {
+		d := make([]byte, dht.NodeIDBytes)
+		for j := range d {
+			d[j] = nodes[i].ID[j] ^ infoHash[j]
+		}
+		return d
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(distance(order[a]), distance(order[b])) < 0
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&announced[order[0]]) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&announced[order[0]]) == 0 {
+		t.Error("the closest node to the infohash received no announce")
+	}
+	reached := 0
+	for _, i := range order[:8] {
+		reached += int(atomic.LoadInt32(&announced[i]))
+	}
+	if reached < 6 {
+		t.Errorf("only %d of the 8 closest nodes received the announce", reached)
+	}
+}
@@ -0,0 +1,503 @@
+// Package dhttest provides fake remote DHT nodes for unit tests of code
+// built on package dht.
+//
+// A Remote answers KRPC queries with scripted replies, errors, delays or
+// malformed packets and records every query it receives:
+//
+//	remote, err := dhttest.NewRemote()
+//	...
+//	defer remote.Close()
+//	remote.Handle(dht.FindNodeType, dhttest.Respond(dhttest.Reply{Nodes: contacts}))
+//
+//	node := dht.NewNode(
+//		dht.OptionRouters(remote.Addr().String()),
+//		dht.OptionIPFilter(nil), // admit loopback addresses
+//		...
+//	)
+//	...
+//	q, err := remote.WaitQuery(ctx, dht.FindNodeType)
+//
+// Remotes listen on loopback by default, NewRemoteConn runs one on any
+// net.PacketConn, such as an endpoint of a dhtsim network.
+package dhttest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+	"github.com/bttown/dht"
+)
+
+var (
+	ErrClosed    = errors.New("dhttest: remote closed")
+	ErrMalformed = errors.New("dhttest: malformed KRPC message")
+)
+
+// DefaultToken is the write token returned to get_peers queries by
+// default.
+const DefaultToken = "dhttest"
+
+// Query is a query received by a Remote.
+type Query struct {
+	*dht.KRPCQuery
+
+	From     *net.UDPAddr
+	Raw      []byte
+	Received time.Time
+}
+
+// Error is a KRPC error message.
+type Error = dht.KRPCError
+
+// Reply scripts the answer to one query. The zero value answers with the
+// remote's ID only.
+type Reply struct {
+	// Delay postpones the answer.
+	Delay time.Duration
+	// Drop leaves the query unanswered.
+	Drop bool
+	// Raw, if not nil, is sent as is; use it for malformed packets.
+	Raw []byte
+	// Error, if not nil, is sent instead of a response.
+	Error *Error
+
+	// ID overrides the remote's ID in the response.
+	ID *dht.NodeID
+	// Token is the write token, DefaultToken for get_peers by default.
+	Token string
+	// Nodes are sent as compact node info in "nodes".
+	Nodes []*dht.NodeInfo
+	// Values are compact peer infos sent in "values".
+	Values []string
+}
+
+// Handler returns the reply to q.
+type Handler func(q *Query) Reply
+
+// Respond returns a handler answering every query with r.
+func Respond(r Reply) Handler {
+	return func(*Query) Reply {
+		return r
+	}
+}
+
+// Sequence returns a handler answering the n-th query with replies[n]
+// and every later query with the last reply.
+func Sequence(replies ...Reply) Handler {
+	var mu sync.Mutex
+	var n int
+	return func(*Query) Reply {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(replies) == 0 {
+			return Reply{}
+		}
+		r := replies[n]
+		if n < len(replies)-1 {
+			n++
+		}
+		return r
+	}
+}
+
+// Remote is a fake DHT node.
+type Remote struct {
+	ID dht.NodeID
+
+	conn    net.PacketConn
+	ownConn bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	handlers  map[dht.QueryType]Handler
+	queries   []*Query
+	malformed int
+	changed   chan struct{}
+	pending   map[string]chan interface{}
+	closed    bool
+}
+
+// NewRemote starts a remote with a random ID on a loopback UDP port.
+func NewRemote() (*Remote, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := NewRemoteConn(conn)
+	r.ownConn = true
+	return r, nil
+}
+
+// NewRemoteConn starts a remote with a random ID reading from conn. Close
+// does not close conn.
+func NewRemoteConn(conn net.PacketConn) *Remote {
+	r := &Remote{
+		ID:       dht.GenerateNodeID(),
+		conn:     conn,
+		done:     make(chan struct{}),
+		handlers: make(map[dht.QueryType]Handler),
+		changed:  make(chan struct{}),
+		pending:  make(map[string]chan interface{}),
+	}
+	r.wg.Add(1)
+	go r.serve()
+	return r
+}
+
+// Addr returns the address the remote is listening on.
+func (r *Remote) Addr() *net.UDPAddr {
+	addr, _ := resolve(r.conn.LocalAddr())
+	return addr
+}
+
+// NodeInfo returns the remote as a contact, for OptionBootstrapContacts.
+func (r *Remote) NodeInfo() *dht.NodeInfo {
+	return &dht.NodeInfo{ID: r.ID, UDPAddr: *r.Addr()}
+}
+
+// Handle scripts the replies to queries of the given method. A nil
+// handler restores the default, which answers every known method with
+// the remote's ID, and a token for get_peers, and unknown methods with
+// error 204.
+func (r *Remote) Handle(method dht.QueryType, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h == nil {
+		delete(r.handlers, method)
+		return
+	}
+	r.handlers[method] = h
+}
+
+// Queries returns the queries received so far, oldest first.
+func (r *Remote) Queries() []*Query {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Query(nil), r.queries...)
+}
+
+// Malformed returns the number of packets that could not be decoded.
+func (r *Remote) Malformed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.malformed
+}
+
+// Reset forgets the recorded queries.
+func (r *Remote) Reset() {
+	r.mu.Lock()
+	r.queries = nil
+	r.malformed = 0
+	r.mu.Unlock()
+}
+
+// WaitQuery returns the first recorded query of the given method, waiting
+// for one until ctx is done. An empty method matches any query.
+func (r *Remote) WaitQuery(ctx context.Context, method dht.QueryType) (*Query, error) {
+	for {
+		r.mu.Lock()
+		for _, q := range r.queries {
+			if method == "" || q.Q == method {
+				r.mu.Unlock()
+				return q, nil
+			}
+		}
+		changed, closed := r.changed, r.closed
+		r.mu.Unlock()
+
+		if closed {
+			return nil, ErrClosed
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Send sends b to addr as is, e.g. to feed a node malformed packets.
+func (r *Remote) Send(addr net.Addr, b []byte) error {
+	_, err := r.conn.WriteTo(b, addr)
+	return err
+}
+
+// Query sends q to addr and waits for the answer. The query's ID is set to
+// the remote's and, if empty, a transaction ID is generated. A KRPC error
+// answer is returned as *Error.
+func (r *Remote) Query(ctx context.Context, addr net.Addr, q *dht.KRPCQuery) (*dht.KRPCResponse, error) {
+	q.NID = r.ID
+	if len(q.T) == 0 {
+		id := dht.GenerateNodeID()
+		q.T = id[:4]
+	}
+	b, err := q.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan interface{}, 1)
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrClosed
+	}
+	r.pending[string(q.T)] = c
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, string(q.T))
+		r.mu.Unlock()
+	}()
+
+	if err := r.Send(addr, b); err != nil {
+		return nil, err
+	}
+
+	select {
+	case v := <-c:
+		if err, ok := v.(error); ok {
+			return nil, err
+		}
+		return v.(*dht.KRPCResponse), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops the remote and waits for pending replies to be sent or
+// dropped.
+func (r *Remote) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.done)
+	close(r.changed)
+	r.mu.Unlock()
+
+	var err error
+	if r.ownConn {
+		err = r.conn.Close()
+	} else {
+		r.conn.SetReadDeadline(time.Now())
+	}
+	r.wg.Wait()
+	return err
+}
+
+func (r *Remote) serve() {
+	defer r.wg.Done()
+
+	buf := make([]byte, 8192)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		addr, err := resolve(from)
+		if err != nil {
+			continue
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		r.handlePacket(addr, b)
+	}
+}
+
+func (r *Remote) handlePacket(from *net.UDPAddr, b []byte) {
+	data, err := decode(b)
+	if err != nil {
+		r.mu.Lock()
+		r.malformed++
+		r.mu.Unlock()
+		return
+	}
+
+	t, _ := data["t"].([]byte)
+	y, _ := data["y"].([]byte)
+	switch string(y) {
+	case "q":
+		query := new(dht.KRPCQuery)
+		if err := load(func() error { return query.Loads(data) }); err != nil {
+			r.mu.Lock()
+			r.malformed++
+			r.mu.Unlock()
+			return
+		}
+		r.handleQuery(&Query{KRPCQuery: query, From: from, Raw: b, Received: time.Now()})
+	case "r":
+		resp := new(dht.KRPCResponse)
+		if err := load(func() error { return resp.Loads(data) }); err != nil {
+			r.answer(t, err)
+			return
+		}
+		r.answer(t, resp)
+	case "e":
+		r.answer(t, decodeError(data))
+	default:
+		r.mu.Lock()
+		r.malformed++
+		r.mu.Unlock()
+	}
+}
+
+func (r *Remote) handleQuery(q *Query) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.queries = append(r.queries, q)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	h := r.handlers[q.Q]
+	r.mu.Unlock()
+
+	var reply Reply
+	if h != nil {
+		reply = h(q)
+	} else {
+		reply = r.defaultReply(q)
+	}
+	if reply.Drop {
+		return
+	}
+
+	b := reply.Raw
+	if b == nil {
+		var err error
+		if b, err = r.encodeReply(q, reply); err != nil {
+			return
+		}
+	}
+
+	if reply.Delay <= 0 {
+		r.conn.WriteTo(b, q.From)
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		select {
+		case <-time.After(reply.Delay):
+			r.conn.WriteTo(b, q.From)
+		case <-r.done:
+		}
+	}()
+}
+
+func (r *Remote) defaultReply(q *Query) Reply {
+	switch q.Q {
+	case dht.PingType, dht.FindNodeType, dht.GetPeersType, dht.AnnouncePeerType:
+		return Reply{}
+	}
+	return Reply{Error: dht.KRPCErrMethodUnknown}
+}
+
+func (r *Remote) encodeReply(q *Query, reply Reply) ([]byte, error) {
+	if reply.Error != nil {
+		return bencode.Marshal(map[string]interface{}{
+			"t": q.T,
+			"y": []byte("e"),
+			"e": []interface{}{int64(reply.Error.Code), []byte(reply.Error.Message)},
+		})
+	}
+
+	id := r.ID
+	if reply.ID != nil {
+		id = *reply.ID
+	}
+	args := map[string]interface{}{
+		"id": id[:],
+	}
+
+	token := reply.Token
+	if token == "" && q.Q == dht.GetPeersType {
+		token = DefaultToken
+	}
+	if token != "" {
+		args["token"] = []byte(token)
+	}
+	if len(reply.Nodes) > 0 {
+		args["nodes"] = dht.CompactNodeInfos(reply.Nodes)
+	}
+	if len(reply.Values) > 0 {
+		values := make([]interface{}, 0, len(reply.Values))
+		for _, v := range reply.Values {
+			values = append(values, []byte(v))
+		}
+		args["values"] = values
+	}
+
+	return bencode.Marshal(map[string]interface{}{
+		"t": q.T,
+		"y": []byte("r"),
+		"r": args,
+	})
+}
+
+func (r *Remote) answer(t []byte, v interface{}) {
+	r.mu.Lock()
+	c := r.pending[string(t)]
+	r.mu.Unlock()
+
+	if c == nil {
+		return
+	}
+	select {
+	case c <- v:
+	default:
+	}
+}
+
+func decode(b []byte) (map[string]interface{}, error) {
+	v, err := bencode.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrMalformed
+	}
+	return data, nil
+}
+
+func decodeError(data map[string]interface{}) error {
+	e, ok := data["e"].([]interface{})
+	if !ok || len(e) < 2 {
+		return ErrMalformed
+	}
+	code, _ := e[0].(int64)
+	msg, _ := e[1].([]byte)
+	return &Error{Code: int(code), Message: string(msg)}
+}
+
+// load runs one of the dht Loads methods, which panic on messages with
+// unexpected types.
+func load(f func() error) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrMalformed
+		}
+	}()
+	return f()
+}
+
+func resolve(addr net.Addr) (*net.UDPAddr, error) {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
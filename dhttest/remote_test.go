@@ -0,0 +1,185 @@
+package dhttest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bttown/dht"
+)
+
+func newRemote(t *testing.T) *Remote {
+	r, err := NewRemote()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestScriptedLookup(t *testing.T) {
+	router, contact := newRemote(t), newRemote(t)
+	defer router.Close()
+	defer contact.Close()
+
+	router.Handle(dht.FindNodeType, Respond(Reply{Nodes: []*dht.NodeInfo{contact.NodeInfo()}}))
+
+	node := dht.NewNode(
+		dht.OptionAddress("127.0.0.1:0"),
+		dht.OptionDumpFile(""),
+		dht.OptionIPFilter(nil),
+		dht.OptionRouters(router.Addr().String()),
+	)
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	q, err := router.WaitQuery(ctx, dht.FindNodeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.NID != node.ID {
+		t.Errorf("query from %x, want %x", q.NID, node.ID)
+	}
+
+	if _, err := contact.WaitQuery(ctx, dht.FindNodeType); err != nil {
+		t.Fatalf("node did not query the contact returned by the router: %v", err)
+	}
+}
+
+func TestQueryNode(t *testing.T) {
+	announced := make(chan string, 1)
+	node := dht.NewNode(dht.OptionAddress("127.0.0.1:0"), dht.OptionDumpFile(""), dht.OptionIPFilter(nil), dht.OptionRouters())
+	node.PeerHandler = func(ip string, port int, infoHash, peerID string) {
+		announced <- infoHash
+	}
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown(context.Background())
+
+	remote := newRemote(t)
+	defer remote.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	resp, err := remote.Query(ctx, node.LocalAddr(), &dht.KRPCQuery{
+		Q:        dht.GetPeersType,
+		InfoHash: infoHash,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = remote.Query(ctx, node.LocalAddr(), &dht.KRPCQuery{
+		Q:        dht.AnnouncePeerType,
+		InfoHash: infoHash,
+		Port:     6881,
+		Token:    resp.Token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.QueriedID != node.ID {
+		t.Errorf("response from %x, want %x", resp.QueriedID, node.ID)
+	}
+
+	select {
+	case h := <-announced:
+		if h != "abababababababababababababababababababab" {
+			t.Errorf("announced %s", h)
+		}
+	case <-ctx.Done():
+		t.Fatal("PeerHandler was not called")
+	}
+}
+
+func TestErrorsDelaysAndMalformed(t *testing.T) {
+	client, server := newRemote(t), newRemote(t)
+	defer client.Close()
+	defer server.Close()
+
+	server.Handle(dht.PingType, Sequence(
+		Reply{Error: &Error{Code: 201, Message: "A Generic Error Ocurred"}},
+		Reply{Delay: 200 * time.Millisecond},
+		Reply{Raw: []byte("not bencode")},
+	))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Query(ctx, server.Addr(), &dht.KRPCQuery{Q: dht.PingType})
+	var kerr *Error
+	if !errors.As(err, &kerr) || kerr.Code != 201 {
+		t.Fatalf("got %v, want error 201", err)
+	}
+
+	start := time.Now()
+	resp, err := client.Query(ctx, server.Addr(), &dht.KRPCQuery{Q: dht.PingType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("delayed reply arrived after %v", d)
+	}
+	if resp.QueriedID != server.ID {
+		t.Errorf("response from %x, want %x", resp.QueriedID, server.ID)
+	}
+
+	short, cancelShort := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelShort()
+	if _, err := client.Query(short, server.Addr(), &dht.KRPCQuery{Q: dht.PingType}); err != context.DeadlineExceeded {
+		t.Errorf("got %v for a malformed reply, want a timeout", err)
+	}
+	if n := client.Malformed(); n != 1 {
+		t.Errorf("%d malformed packets recorded, want 1", n)
+	}
+
+	if n := len(server.Queries()); n != 3 {
+		t.Errorf("%d queries recorded, want 3", n)
+	}
+}
+
+func TestAnnounceRefusedToken(t *testing.T) {
+	remote := newRemote(t)
+	defer remote.Close()
+	remote.Handle(dht.AnnouncePeerType, Respond(Reply{Error: &Error{Code: 203, Message: "bad token"}}))
+
+	node := dht.NewNode(
+		dht.OptionAddress("127.0.0.1:0"),
+		dht.OptionDumpFile(""),
+		dht.OptionIPFilter(nil),
+		dht.OptionRouters(remote.Addr().String()),
+	)
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown(context.Background())
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(node.Contacts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(node.Contacts()) == 0 {
+		t.Fatal("the node did not add the remote to its routing table")
+	}
+
+	err := node.Announce(bytes.Repeat([]byte{0xab}, 20), 6881)
+	if !errors.Is(err, dht.KRPCErrProtocol) {
+		t.Fatalf("got %v, want the protocol error of the remote", err)
+	}
+	q, err := remote.WaitQuery(context.Background(), dht.AnnouncePeerType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Token != DefaultToken {
+		t.Errorf("announced with token %q, want %q", q.Token, DefaultToken)
+	}
+}
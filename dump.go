@@ -0,0 +1,235 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bttown/routing-table"
+)
+
+// Routing table dump file layout, all integers big endian:
+//
+//	magic   [4]byte "KTB\x00"
+//	version uint8
+//	node id [20]byte
+//	tokens  { secret [8]byte, previous [8]byte, rotated int64 }, since version 2
+//	count   uint32
+//	count * { node id [20]byte, ip length uint8, ip, port uint16 }
+//
+// rotated is the time the write token secret last changed, in Unix
+// nanoseconds. Version 1 dumps are still read.
+const (
+	dumpMagic   = "KTB\x00"
+	dumpVersion = 2
+
+	maxDumpContacts     = 2048
+	defaultDumpInterval = 5 * time.Minute
+)
+
+var (
+	ErrDumpFormat  = errors.New("invalid routing table dump")
+	ErrDumpVersion = errors.New("unsupported routing table dump version")
+)
+
+func encodeDump(id NodeID, tokens tokenSecrets, nodes []*NodeInfo) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(dumpMagic)
+	buf.WriteByte(dumpVersion)
+	buf.Write(id[:])
+
+	buf.Write(tokens.secret[:])
+	buf.Write(tokens.previous[:])
+	var rotated [8]byte
+	if !tokens.rotated.IsZero() {
+		binary.BigEndian.PutUint64(rotated[:], uint64(tokens.rotated.UnixNano()))
+	}
+	buf.Write(rotated[:])
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(nodes)))
+	buf.Write(b[:])
+
+	for _, info := range nodes {
+		ip := info.IP.To4()
+		if ip == nil {
+			ip = info.IP.To16()
+		}
+		buf.Write(info.ID[:])
+		buf.WriteByte(byte(len(ip)))
+		buf.Write(ip)
+		binary.BigEndian.PutUint16(b[:2], uint16(info.Port))
+		buf.Write(b[:2])
+	}
+
+	return buf.Bytes()
+}
+
+func decodeDump(b []byte) (NodeID, tokenSecrets, []*NodeInfo, error) {
+	var (
+		id     NodeID
+		tokens tokenSecrets
+	)
+	header := len(dumpMagic) + 1 + NodeIDBytes + 4
+	if len(b) < header || string(b[:len(dumpMagic)]) != dumpMagic {
+		return id, tokens, nil, ErrDumpFormat
+	}
+	version := b[len(dumpMagic)]
+	if version != 1 && version != dumpVersion {
+		return id, tokens, nil, ErrDumpVersion
+	}
+
+	b = b[len(dumpMagic)+1:]
+	copy(id[:], b[:NodeIDBytes])
+	b = b[NodeIDBytes:]
+	if version >= 2 {
+		if len(b) < 8+8+8+4 {
+			return id, tokens, nil, ErrDumpFormat
+		}
+		copy(tokens.secret[:], b[:8])
+		copy(tokens.previous[:], b[8:16])
+		if rotated := int64(binary.BigEndian.Uint64(b[16:24])); rotated != 0 {
+			tokens.rotated = time.Unix(0, rotated)
+		}
+		b = b[24:]
+	}
+	count := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	if count > maxDumpContacts {
+		return id, tokens, nil, ErrDumpFormat
+	}
+
+	nodes := make([]*NodeInfo, 0, count)
+	for i := 0; i < count; i++ {
+		if len(b) < NodeIDBytes+1 {
+			return id, tokens, nil, ErrDumpFormat
+		}
+		info := new(NodeInfo)
+		copy(info.ID[:], b[:NodeIDBytes])
+		ipLen := int(b[NodeIDBytes])
+		b = b[NodeIDBytes+1:]
+		if (ipLen != net.IPv4len && ipLen != net.IPv6len) || len(b) < ipLen+2 {
+			return id, tokens, nil, ErrDumpFormat
+		}
+		info.IP = make(net.IP, ipLen)
+		copy(info.IP, b[:ipLen])
+		info.Port = int(binary.BigEndian.Uint16(b[ipLen:]))
+		b = b[ipLen+2:]
+
+		nodes = append(nodes, info)
+	}
+
+	return id, tokens, nodes, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filename and
+// renames it into place, so readers never see a half written dump.
+func writeFileAtomic(filename string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// Contacts returns the contacts of the routing table, closest to our own
+// ID first.
+func (node *Node) Contacts() []*NodeInfo {
+	entries := node.table.Closest(table.Hash(node.ID), maxDumpContacts).Entries()
+	nodes := make([]*NodeInfo, 0, len(entries))
+	for _, c := range entries {
+		nodes = append(nodes, &NodeInfo{
+			ID:      NodeID(c.NID),
+			UDPAddr: c.UDPAddr,
+		})
+	}
+	return nodes
+}
+
+// SaveRoutingTable writes the node ID, the routing table contacts and the
+// secrets of the announce tokens we give out to the dump file. It does
+// nothing if no dump file is configured.
+func (node *Node) SaveRoutingTable() error {
+	if node.dumpFileName == "" {
+		return nil
+	}
+	return writeFileAtomic(node.dumpFileName, encodeDump(node.ID, node.writeTokens.secrets(), node.Contacts()))
+}
+
+// loadRoutingTable reads the dump file. The saved node ID is adopted
+// unless one was set with OptionNodeID, or ErrIdentityExists returned if
+// it is one of the node's other identities. The tokens given out before the
+// restart are accepted again, and the saved contacts are returned so they
+// can be pinged before falling back to the routers.
+func (node *Node) loadRoutingTable() ([]*NodeInfo, error) {
+	if node.dumpFileName == "" {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadFile(node.dumpFileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	id, tokens, nodes, err := decodeDump(b)
+	if err != nil {
+		return nil, err
+	}
+	node.writeTokens.restore(tokens)
+
+	if !node.fixedID && id != node.ID {
+		for _, ident := range node.identities.all() {
+			if ident.id == id {
+				return nil, ErrIdentityExists
+			}
+		}
+		node.ID = id
+		node.table.Stop()
+		node.initTable()
+	}
+	return nodes, nil
+}
+
+func (node *Node) dumpLoop() {
+	interval := node.dumpInterval
+	if interval <= 0 {
+		interval = defaultDumpInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-node.closed:
+			return
+		case <-ticker.C:
+			if err := node.SaveRoutingTable(); err != nil {
+				node.logger.Warn("save routing table", "file", node.dumpFileName, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package dht
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumpRoundTrip(t *testing.T) {
+	id := GenerateNodeID()
+	nodes := []*NodeInfo{
+		{ID: GenerateNodeID(), UDPAddr: net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}},
+		{ID: GenerateNodeID(), UDPAddr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}},
+	}
+
+	dir, err := ioutil.TempDir("", "dht-dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "dump.ktb")
+	if err := writeFileAtomic(filename, encodeDump(id, tokenSecrets{}, nodes)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotID, _, got, err := decodeDump(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id {
+		t.Error("node ID was not restored")
+	}
+	if len(got) != len(nodes) {
+		t.Fatalf("expected %d contacts, got %d", len(nodes), len(got))
+	}
+	for i := range nodes {
+		if got[i].ID != nodes[i].ID || !got[i].IP.Equal(nodes[i].IP) || got[i].Port != nodes[i].Port {
+			t.Errorf("contact %d: expected %v, got %v", i, nodes[i], got[i])
+		}
+	}
+
+	b[len(dumpMagic)] = dumpVersion + 1
+	if _, _, _, err := decodeDump(b); err != ErrDumpVersion {
+		t.Errorf("expected ErrDumpVersion, got %v", err)
+	}
+}
+
+func TestTokensSurviveRestart(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dump.ktb")
+	ip := net.IPv4(1, 2, 3, 4)
+
+	before := newTestNode(t, OptionDumpFile(filename))
+	token := before.writeTokens.issue(ip)
+	if err := before.SaveRoutingTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := newTestNode(t, OptionDumpFile(filename))
+	if !after.writeTokens.valid(token, ip) {
+		t.Error("token given out before the restart was refused")
+	}
+
+	expired := newWriteTokens()
+	secrets := before.writeTokens.secrets()
+	secrets.rotated = secrets.rotated.Add(-2 * writeTokenRotation)
+	expired.restore(secrets)
+	if expired.valid(token, ip) {
+		t.Error("secrets older than two rotations were restored")
+	}
+}
+
+func TestSavedIDIsIdentity(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dump.ktb")
+	id := GenerateNodeID()
+	if err := writeFileAtomic(filename, encodeDump(id, tokenSecrets{}, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	node := NewNode(testNodeOptions(OptionDumpFile(filename), OptionIdentities(id))...)
+	defer node.Shutdown(context.Background())
+	if err := node.Start(context.Background()); err != ErrIdentityExists {
+		t.Fatalf("got %v starting with the saved ID as an identity, want ErrIdentityExists", err)
+	}
+	if node.ID == id {
+		t.Error("the saved ID was adopted")
+	}
+}
@@ -0,0 +1,266 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventQueue configures the delivery of events to the handlers, see
+// OptionEventQueue. Events are queued by the packet handlers and delivered
+// by the queue's own workers, so a slow EventHandler or PeerHandler does
+// not delay the replies.
+type EventQueue struct {
+	// Workers is the number of events delivered concurrently, 1 if zero.
+	// With more than one worker, events may be delivered out of order.
+	Workers int
+	// QueueSize is the number of events waiting for a worker, 1024 if
+	// zero.
+	QueueSize int
+	// Policy applies when the queue is full. Block holds the packet
+	// handler until a worker is free.
+	Policy DropPolicy
+}
+
+// EventStats reports the state of the event queue.
+type EventStats struct {
+	// Queued is the number of events waiting for a worker.
+	Queued int
+	// Delivered and Dropped count the events since the node started.
+	Delivered uint64
+	Dropped   uint64
+	// Lag is how long the last delivered event waited in the queue, and
+	// MaxLag the longest wait.
+	Lag    time.Duration
+	MaxLag time.Duration
+}
+
+type queuedEvent struct {
+	deliver func(h EventHandler)
+	at      time.Time
+	seq     uint64
+}
+
+type eventQueue struct {
+	delivered, dropped uint64
+	lag, maxLag        int64
+
+	config EventQueue
+	queue  chan queuedEvent
+	stop   chan struct{}
+	once   sync.Once
+
+	// events are numbered when pushed, done is the number of the first
+	// event not delivered or dropped yet and finished the later ones that
+	// are, since workers may finish out of order. Flush waits in waiters
+	// until done passes the events pushed before it was called.
+	mu       sync.Mutex
+	next     uint64
+	done     uint64
+	finished map[uint64]bool
+	waiters  []flushWaiter
+}
+
+type flushWaiter struct {
+	seq uint64
+	ch  chan struct{}
+}
+
+func newEventQueue(config EventQueue) *eventQueue {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	return &eventQueue{
+		config:   config,
+		queue:    make(chan queuedEvent, config.QueueSize),
+		stop:     make(chan struct{}),
+		finished: make(map[uint64]bool),
+	}
+}
+
+// finish records that the event seq was delivered or dropped and wakes
+// the flushes it completes.
+func (q *eventQueue) finish(seq uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.finished[seq] = true
+	for q.finished[q.done] {
+		delete(q.finished, q.done)
+		q.done++
+	}
+
+	waiters := q.waiters[:0]
+	for _, w := range q.waiters {
+		if q.done >= w.seq {
+			close(w.ch)
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	q.waiters = waiters
+}
+
+func (q *eventQueue) drop(seq uint64) {
+	atomic.AddUint64(&q.dropped, 1)
+	q.finish(seq)
+}
+
+// push queues ev according to the drop policy. It only blocks with the
+// Block policy, until a worker is free or the queue is stopped. Events
+// pushed once the queue is stopped are dropped.
+func (q *eventQueue) push(ev queuedEvent) {
+	q.mu.Lock()
+	ev.seq = q.next
+	q.next++
+	q.mu.Unlock()
+
+	select {
+	case <-q.stop:
+		q.drop(ev.seq)
+		return
+	default:
+	}
+
+	switch q.config.Policy {
+	case Block:
+		select {
+		case q.queue <- ev:
+		case <-q.stop:
+			q.drop(ev.seq)
+			return
+		}
+	case DropOldest:
+		for queued := false; !queued; {
+			select {
+			case q.queue <- ev:
+				queued = true
+			default:
+				select {
+				case old := <-q.queue:
+					q.drop(old.seq)
+				default:
+				}
+			}
+		}
+	default:
+		select {
+		case q.queue <- ev:
+		default:
+			q.drop(ev.seq)
+			return
+		}
+	}
+
+	// the queue may have been stopped, and drained, while ev was queued
+	select {
+	case <-q.stop:
+		q.drain()
+	default:
+	}
+}
+
+// drain drops the events left in the stopped queue.
+func (q *eventQueue) drain() {
+	for {
+		select {
+		case ev := <-q.queue:
+			q.drop(ev.seq)
+		default:
+			return
+		}
+	}
+}
+
+// run delivers the queued events to the node's handlers until the queue
+// is stopped.
+func (q *eventQueue) run(node *Node) {
+	for {
+		select {
+		case ev := <-q.queue:
+			lag := int64(time.Since(ev.at))
+			atomic.StoreInt64(&q.lag, lag)
+			for {
+				max := atomic.LoadInt64(&q.maxLag)
+				if lag <= max || atomic.CompareAndSwapInt64(&q.maxLag, max, lag) {
+					break
+				}
+			}
+
+			node.deliver(ev.deliver)
+			atomic.AddUint64(&q.delivered, 1)
+			q.finish(ev.seq)
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// flush waits until the events pushed so far are delivered or dropped,
+// or ctx is done. Events pushed meanwhile are not waited for.
+func (q *eventQueue) flush(ctx context.Context) error {
+	q.mu.Lock()
+	if q.done >= q.next {
+		q.mu.Unlock()
+		return nil
+	}
+	w := flushWaiter{seq: q.next, ch: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ch:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		for i, other := range q.waiters {
+			if other.ch == w.ch {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				break
+			}
+		}
+		q.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (q *eventQueue) close() {
+	q.once.Do(func() {
+		close(q.stop)
+		q.drain()
+	})
+}
+
+func (q *eventQueue) stats() EventStats {
+	return EventStats{
+		Queued:    len(q.queue),
+		Delivered: atomic.LoadUint64(&q.delivered),
+		Dropped:   atomic.LoadUint64(&q.dropped),
+		Lag:       time.Duration(atomic.LoadInt64(&q.lag)),
+		MaxLag:    time.Duration(atomic.LoadInt64(&q.maxLag)),
+	}
+}
+
+// startEventWorkers runs the event workers until the queue is closed on
+// Shutdown, after the last events were flushed.
+func (node *Node) startEventWorkers() {
+	for i := 0; i < node.eventQueue.config.Workers; i++ {
+		go node.eventQueue.run(node)
+	}
+}
+
+// Flush waits until the events queued so far are delivered or dropped, or
+// ctx is done. Events queued meanwhile are not waited for. Shutdown
+// flushes the queue before it returns.
+func (node *Node) Flush(ctx context.Context) error {
+	return node.eventQueue.flush(ctx)
+}
+
+// EventStats returns the depth, counters and lag of the event queue.
+func (node *Node) EventStats() EventStats {
+	return node.eventQueue.stats()
+}
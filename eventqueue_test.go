@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingHandler struct {
+	NopEventHandler
+	pings   int64
+	release chan struct{}
+}
+
+func (h *countingHandler) OnPing(e PingEvent) {
+	<-h.release
+	atomic.AddInt64(&h.pings, 1)
+}
+
+func TestEventQueuePolicies(t *testing.T) {
+	for _, policy := range []DropPolicy{DropNewest, DropOldest} {
+		h := &countingHandler{release: make(chan struct{})}
+		node := NewNode(OptionDumpFile(""), OptionEventHandler(h), OptionEventQueue(EventQueue{QueueSize: 2, Policy: policy}))
+
+		var order []int
+		for i := 0; i < 4; i++ {
+			i := i
+			node.emit(func(h EventHandler) {
+				order = append(order, i)
+				h.OnPing(PingEvent{})
+			})
+		}
+		stats := node.EventStats()
+		if stats.Queued != 2 || stats.Dropped != 2 {
+			t.Errorf("policy %d: unexpected stats %+v", policy, stats)
+		}
+
+		close(h.release)
+		node.startEventWorkers()
+		if err := node.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		want := []int{0, 1}
+		if policy == DropOldest {
+			want = []int{2, 3}
+		}
+		if len(order) != 2 || order[0] != want[0] || order[1] != want[1] {
+			t.Errorf("policy %d: delivered %v, want %v", policy, order, want)
+		}
+		if stats := node.EventStats(); stats.Delivered != 2 || stats.Lag <= 0 || stats.MaxLag < stats.Lag {
+			t.Errorf("policy %d: unexpected stats %+v", policy, stats)
+		}
+		node.eventQueue.close()
+	}
+}
+
+func TestShutdownFlushesEvents(t *testing.T) {
+	h := &countingHandler{release: make(chan struct{})}
+	node := newTestNode(t, OptionEventHandler(h), OptionEventQueue(EventQueue{Policy: Block}))
+	for i := 0; i < 10; i++ {
+		node.emit(func(h EventHandler) { h.OnPing(PingEvent{}) })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := node.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v flushing blocked events", err)
+	}
+
+	close(h.release)
+	if err := node.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&h.pings); n != 10 {
+		t.Errorf("%d events delivered before Shutdown returned, want 10", n)
+	}
+}
+
+func TestFlushUnderLoad(t *testing.T) {
+	h := &countingHandler{release: make(chan struct{})}
+	close(h.release)
+	node := NewNode(OptionDumpFile(""), OptionEventHandler(h), OptionEventQueue(EventQueue{Workers: 4, Policy: Block}))
+	node.startEventWorkers()
+	defer node.eventQueue.close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				node.emit(func(h EventHandler) { h.OnPing(PingEvent{}) })
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := node.Flush(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("flush %d under continuous traffic: %v", i, err)
+		}
+	}
+}
+
+func TestFlushAfterShutdown(t *testing.T) {
+	for _, policy := range []DropPolicy{DropNewest, DropOldest, Block} {
+		h := &countingHandler{release: make(chan struct{})}
+		close(h.release)
+		node := newTestNode(t, OptionEventHandler(h), OptionEventQueue(EventQueue{Policy: policy}))
+		if err := node.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		node.emit(func(h EventHandler) { h.OnPing(PingEvent{}) })
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if err := node.Flush(ctx); err != nil {
+			t.Errorf("policy %v: got %v flushing after Shutdown", policy, err)
+		}
+		cancel()
+		if stats := node.EventStats(); stats.Dropped != 1 || stats.Queued != 0 {
+			t.Errorf("policy %v: event pushed after Shutdown left %+v", policy, stats)
+		}
+	}
+}
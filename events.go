@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// EventHandler receives the traffic of a node, see OptionEventHandler.
+// Events are delivered asynchronously through the node's EventQueue. They
+// only reference memory of their own and can be kept. Embed
+// NopEventHandler to implement only some of the methods.
+type EventHandler interface {
+	// OnAnnounce is called for announce_peer queries, see
+	// BanPolicy.RejectInvalidTokens.
+	OnAnnounce(e AnnounceEvent)
+	// OnGetPeers is called for get_peers queries.
+	OnGetPeers(e GetPeersEvent)
+	// OnFindNode is called for find_node queries.
+	OnFindNode(e FindNodeEvent)
+	// OnPing is called for ping queries.
+	OnPing(e PingEvent)
+	// OnResponse is called for responses to our queries.
+	OnResponse(e ResponseEvent)
+	// OnError is called for KRPC error messages answering our queries.
+	OnError(e ErrorEvent)
+	// OnNodeDiscovered is called for the contacts in the responses to our
+	// queries that are neither filtered nor banned.
+	OnNodeDiscovered(e NodeDiscoveredEvent)
+}
+
+// AnnounceEvent is an announce_peer query: the querying node is a peer of
+// the torrent InfoHash listening on Port, which is already the source
+// port when the query sets implied_port.
+type AnnounceEvent struct {
+	Node     NodeInfo
+	InfoHash []byte
+	Port     int
+	// ValidToken reports whether the query carried a token we gave to
+	// the announcing node.
+	ValidToken bool
+	Query      *KRPCQuery
+}
+
+// GetPeersEvent is a get_peers query for the torrent InfoHash.
+type GetPeersEvent struct {
+	Node     NodeInfo
+	InfoHash []byte
+	Query    *KRPCQuery
+}
+
+// FindNodeEvent is a find_node query for Target.
+type FindNodeEvent struct {
+	Node   NodeInfo
+	Target NodeID
+	Query  *KRPCQuery
+}
+
+// PingEvent is a ping query.
+type PingEvent struct {
+	Node  NodeInfo
+	Query *KRPCQuery
+}
+
+// ResponseEvent is the response of Node to one of our Method queries.
+type ResponseEvent struct {
+	Node     NodeInfo
+	Method   QueryType
+	Response *KRPCResponse
+}
+
+// ErrorEvent is a KRPC error message answering one of our Method queries.
+// Err is a *KRPCError. The ID of Node is unknown and zero.
+type ErrorEvent struct {
+	Node   NodeInfo
+	Method QueryType
+	Err    error
+}
+
+// NodeDiscoveredEvent is a contact returned by From.
+type NodeDiscoveredEvent struct {
+	Node NodeInfo
+	From NodeInfo
+}
+
+// NopEventHandler ignores all events.
+type NopEventHandler struct{}
+
+func (NopEventHandler) OnAnnounce(e AnnounceEvent)             {}
+func (NopEventHandler) OnGetPeers(e GetPeersEvent)             {}
+func (NopEventHandler) OnFindNode(e FindNodeEvent)             {}
+func (NopEventHandler) OnPing(e PingEvent)                     {}
+func (NopEventHandler) OnResponse(e ResponseEvent)             {}
+func (NopEventHandler) OnError(e ErrorEvent)                   {}
+func (NopEventHandler) OnNodeDiscovered(e NodeDiscoveredEvent) {}
+
+// PeerHandlerFunc adapts a Node.PeerHandler function to EventHandler: it
+// is called with the address of the announcing peer, the hex infohash and
+// the hex node ID of the announcing node.
+type PeerHandlerFunc func(ip string, port int, infoHash, peerID string)
+
+func (f PeerHandlerFunc) OnAnnounce(e AnnounceEvent) {
+	f(e.Node.IP.String(), e.Port, hex.EncodeToString(e.InfoHash), hex.EncodeToString(e.Node.ID[:]))
+}
+
+func (f PeerHandlerFunc) OnGetPeers(e GetPeersEvent)             {}
+func (f PeerHandlerFunc) OnFindNode(e FindNodeEvent)             {}
+func (f PeerHandlerFunc) OnPing(e PingEvent)                     {}
+func (f PeerHandlerFunc) OnResponse(e ResponseEvent)             {}
+func (f PeerHandlerFunc) OnError(e ErrorEvent)                   {}
+func (f PeerHandlerFunc) OnNodeDiscovered(e NodeDiscoveredEvent) {}
+
+// cloneBytes copies b, which may point into a reused packet buffer.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// cloneValue deep copies a decoded bencode value.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return cloneBytes(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = cloneValue(e)
+		}
+		return c
+	case map[string]interface{}:
+		return cloneDict(v)
+	default:
+		return v
+	}
+}
+
+func cloneDict(d map[string]interface{}) map[string]interface{} {
+	if d == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		c[k] = cloneValue(v)
+	}
+	return c
+}
+
+func cloneQuery(query *KRPCQuery) *KRPCQuery {
+	q := *query
+	q.T = cloneBytes(query.T)
+	q.InfoHash = cloneBytes(query.InfoHash)
+	q.Args = cloneDict(query.Args)
+	return &q
+}
+
+func cloneResponse(r *KRPCResponse) *KRPCResponse {
+	c := *r
+	c.T = cloneBytes(r.T)
+	c.Fields = cloneDict(r.Fields)
+	c.Nodes = make([]*NodeInfo, len(r.Nodes))
+	for i, info := range r.Nodes {
+		n := *info
+		c.Nodes[i] = &n
+	}
+	return &c
+}
+
+func newNodeInfo(id NodeID, addr *net.UDPAddr) NodeInfo {
+	return NodeInfo{ID: id, UDPAddr: net.UDPAddr{IP: cloneBytes(addr.IP), Port: addr.Port, Zone: addr.Zone}}
+}
+
+// observed reports whether the node has event handlers, to skip building
+// events nobody receives.
+func (node *Node) observed() bool {
+	return node.events != nil || node.PeerHandler != nil
+}
+
+// emit queues an event, f is called with each handler by the event
+// workers.
+func (node *Node) emit(f func(h EventHandler)) {
+	node.eventQueue.push(queuedEvent{deliver: f, at: time.Now()})
+}
+
+// deliver calls f with the handlers of the node: the one set with
+// OptionEventHandler and PeerHandler.
+func (node *Node) deliver(f func(h EventHandler)) {
+	if node.events != nil {
+		f(node.events)
+	}
+	if node.PeerHandler != nil {
+		f(PeerHandlerFunc(node.PeerHandler))
+	}
+}
@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	NopEventHandler
+	getPeers  chan GetPeersEvent
+	announces chan AnnounceEvent
+	responses chan ResponseEvent
+}
+
+func (r *recorder) OnGetPeers(e GetPeersEvent) { r.getPeers <- e }
+func (r *recorder) OnAnnounce(e AnnounceEvent) { r.announces <- e }
+func (r *recorder) OnResponse(e ResponseEvent) { r.responses <- e }
+
+func TestEventHandler(t *testing.T) {
+	rec := &recorder{
+		getPeers:  make(chan GetPeersEvent, 1),
+		announces: make(chan AnnounceEvent, 1),
+		responses: make(chan ResponseEvent, 1),
+	}
+	peers := make(chan string, 1)
+	node := newTestNode(t, OptionEventHandler(rec), func(node *Node) {
+		node.PeerHandler = func(ip string, port int, infoHash, peerID string) {
+			peers <- infoHash
+		}
+	})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	id := GenerateNodeID()
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	query, _ := (&KRPCQuery{T: []byte("aa"), Q: GetPeersType, NID: id, InfoHash: infoHash}).Encode()
+	conn.WriteTo(query, node.LocalAddr())
+
+	var token string
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for token == "" {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no get_peers response:", err)
+		}
+		if messageType(buf[:n]) == "r" {
+			msg, _ := NewKRPCMessage(buf[:n])
+			r := new(KRPCResponse)
+			r.Loads(msg.data)
+			token = r.Token
+		}
+	}
+
+	select {
+	case e := <-rec.getPeers:
+		if !bytes.Equal(e.InfoHash, infoHash) || e.Node.ID != id || e.Query.Q != GetPeersType {
+			t.Errorf("unexpected get_peers event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnGetPeers was not called")
+	}
+
+	query, _ = (&KRPCQuery{T: []byte("bb"), Q: AnnouncePeerType, NID: id, InfoHash: infoHash, Port: 6881, Token: token}).Encode()
+	conn.WriteTo(query, node.LocalAddr())
+	select {
+	case e := <-rec.announces:
+		if !bytes.Equal(e.InfoHash, infoHash) || e.Port != 6881 || !e.ValidToken {
+			t.Errorf("unexpected announce event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnAnnounce was not called")
+	}
+	select {
+	case h := <-peers:
+		if h != "abababababababababababababababababababab" {
+			t.Errorf("PeerHandler got infohash %s", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PeerHandler was not called")
+	}
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	if err := node.Ping(addr); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no ping received:", err)
+		}
+		if msg, err := NewKRPCMessage(buf[:n]); err == nil && msg.IsQuery() {
+			resp, _ := (&KRPCResponse{T: []byte(msg.T), Q: PingType, QueriedID: id}).Encode()
+			conn.WriteTo(resp, node.LocalAddr())
+			break
+		}
+	}
+	select {
+	case e := <-rec.responses:
+		if e.Method != PingType || e.Node.ID != id || e.Node.Port != addr.Port {
+			t.Errorf("unexpected response event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnResponse was not called")
+	}
+}
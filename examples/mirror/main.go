@@ -0,0 +1,86 @@
+package main
+
+// ./mirror ./torrents 0.0.0.0:8661 6881
+//
+// serves the metadata of every .torrent file in ./torrents over ut_metadata
+// on TCP port 6881 and announces them to the DHT.
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+	"github.com/bttown/dht"
+	"github.com/bttown/dht/metadata"
+)
+
+func loadTorrents(dir string, store *metadata.MemoryStore) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.torrent"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		v, err := bencode.Unmarshal(b)
+		if err != nil {
+			log.Println("skip", file, err)
+			continue
+		}
+		torrent, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		info, err := bencode.Marshal(torrent["info"])
+		if err != nil {
+			log.Println("skip", file, err)
+			continue
+		}
+		log.Println("serving", file, hex.EncodeToString(store.Add(info)))
+	}
+	return nil
+}
+
+func main() {
+	dir, addr, port := os.Args[1], os.Args[2], os.Args[3]
+	peerPort, err := strconv.Atoi(port)
+	if err != nil {
+		panic(err)
+	}
+
+	store := metadata.NewMemoryStore()
+	if err := loadTorrents(dir, store); err != nil {
+		panic(err)
+	}
+
+	provider := metadata.NewProvider(store)
+	go func() {
+		log.Println(provider.ListenAndServe(net.JoinHostPort("", port)))
+	}()
+	defer provider.Close()
+
+	node := dht.NewNode(dht.OptionAddress(addr))
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+
+		for {
+			time.Sleep(30 * time.Second)
+			for _, infoHash := range store.InfoHashes() {
+				node.Announce(infoHash, peerPort)
+			}
+			<-ticker.C
+		}
+	}()
+
+	node.Serve()
+}
@@ -0,0 +1,31 @@
+package dht
+
+import (
+	"context"
+	"testing"
+)
+
+// testNodeOptions returns the options of a node on a random loopback
+// port that neither bootstraps, filters addresses nor dumps its table,
+// followed by opts.
+func testNodeOptions(opts ...NodeOption) []NodeOption {
+	return append([]NodeOption{
+		OptionAddress("127.0.0.1:0"),
+		OptionDumpFile(""),
+		OptionIPFilter(nil),
+		OptionRouters(),
+	}, opts...)
+}
+
+// newTestNode starts a node with testNodeOptions(opts...) that is shut
+// down when the test ends.
+func newTestNode(t *testing.T, opts ...NodeOption) *Node {
+	t.Helper()
+
+	node := NewNode(testNodeOptions(opts...)...)
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Shutdown(context.Background()) })
+	return node
+}
@@ -0,0 +1,250 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bttown/routing-table"
+)
+
+// ErrIdentityExists is returned by AddIdentity for an ID the node already
+// presents.
+var ErrIdentityExists = errors.New("identity already exists")
+
+const (
+	// presentedTTL is how long we remember the ID presented to a remote.
+	presentedTTL = 15 * time.Minute
+	// maxPresented bounds the number of remotes remembered.
+	maxPresented = 1 << 16
+)
+
+// identity is a virtual node ID with its own routing table.
+type identity struct {
+	id    NodeID
+	table *table.Table
+}
+
+type presentedID struct {
+	id    NodeID
+	until time.Time
+}
+
+// identities are the node IDs a node presents besides its own, and the ID
+// last presented to every remote we queried.
+type identities struct {
+	mu        sync.RWMutex
+	list      []*identity
+	presented map[string]presentedID
+	swept     time.Time
+}
+
+func newIdentities() *identities {
+	return &identities{presented: make(map[string]presentedID)}
+}
+
+func (ids *identities) add(id NodeID, pinger table.Pinger) error {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	for _, ident := range ids.list {
+		if ident.id == id {
+			return ErrIdentityExists
+		}
+	}
+	t := table.NewTable(table.Hash(id), pinger)
+	ids.list = append(ids.list, &identity{id: NodeID(t.OwnerID()), table: t})
+	return nil
+}
+
+func (ids *identities) remove(id NodeID) bool {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	for i, ident := range ids.list {
+		if ident.id == id {
+			ident.table.Stop()
+			ids.list = append(ids.list[:i], ids.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// all returns a copy of the list.
+func (ids *identities) all() []*identity {
+	ids.mu.RLock()
+	defer ids.mu.RUnlock()
+	return append([]*identity(nil), ids.list...)
+}
+
+func (ids *identities) len() int {
+	ids.mu.RLock()
+	defer ids.mu.RUnlock()
+	return len(ids.list)
+}
+
+func (ids *identities) stop() {
+	for _, ident := range ids.all() {
+		ident.table.Stop()
+	}
+}
+
+// present remembers that id was presented to addr.
+func (ids *identities) present(addr *net.UDPAddr, id NodeID) {
+	now := time.Now()
+	key := addr.String()
+
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	if len(ids.presented) >= maxPresented && now.Sub(ids.swept) > time.Minute {
+		for k, p := range ids.presented {
+			if now.After(p.until) {
+				delete(ids.presented, k)
+			}
+		}
+		ids.swept = now
+	}
+	if _, ok := ids.presented[key]; !ok && len(ids.presented) >= maxPresented {
+		return
+	}
+	ids.presented[key] = presentedID{id: id, until: now.Add(presentedTTL)}
+}
+
+// presentedTo returns the ID last presented to addr.
+func (ids *identities) presentedTo(addr *net.UDPAddr) (NodeID, bool) {
+	ids.mu.RLock()
+	p, ok := ids.presented[addr.String()]
+	ids.mu.RUnlock()
+
+	if !ok || time.Now().After(p.until) {
+		return NodeID{}, false
+	}
+	return p.id, true
+}
+
+// closer reports whether a is closer to target than b in XOR distance.
+func closer(a, b NodeID, target []byte) bool {
+	for i := range a {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// SpreadNodeIDs returns n random node IDs spread evenly over the keyspace,
+// to be presented with OptionIdentities or AddIdentity.
+func SpreadNodeIDs(n int) []NodeID {
+	ids := make([]NodeID, n)
+	for i := range ids {
+		ids[i] = GenerateNodeID()
+		binary.BigEndian.PutUint16(ids[i][:], uint16(i*(1<<16)/n))
+	}
+	return ids
+}
+
+// AddIdentity makes the node also present itself as id, over the same
+// socket. The identity gets its own routing table, filled by the queries
+// sent as id and the remotes that contact it.
+func (node *Node) AddIdentity(id NodeID) error {
+	if id == node.ID {
+		return ErrIdentityExists
+	}
+	return node.identities.add(id, node)
+}
+
+// RemoveIdentity stops presenting id. It reports false for the node's own
+// ID, which cannot be removed, and for unknown IDs.
+func (node *Node) RemoveIdentity(id NodeID) bool {
+	return node.identities.remove(id)
+}
+
+// Identities returns the IDs the node presents, its own ID first.
+func (node *Node) Identities() []NodeID {
+	ids := []NodeID{node.ID}
+	for _, ident := range node.identities.all() {
+		ids = append(ids, ident.id)
+	}
+	return ids
+}
+
+// closestIdentity returns the ID presented by the node closest to target.
+func (node *Node) closestIdentity(target []byte) NodeID {
+	best := node.ID
+	if len(target) != NodeIDBytes {
+		return best
+	}
+
+	node.identities.mu.RLock()
+	defer node.identities.mu.RUnlock()
+	for _, ident := range node.identities.list {
+		if closer(ident.id, best, target) {
+			best = ident.id
+		}
+	}
+	return best
+}
+
+// tableFor returns the routing table of the identity id, or the node's own
+// table if id is not one of its identities.
+func (node *Node) tableFor(id NodeID) *table.Table {
+	node.identities.mu.RLock()
+	defer node.identities.mu.RUnlock()
+	for _, ident := range node.identities.list {
+		if ident.id == id {
+			return ident.table
+		}
+	}
+	return node.table
+}
+
+// present remembers the ID presented to addr when it may differ from the
+// one the node would pick to reply.
+func (node *Node) present(addr *net.UDPAddr, id NodeID) {
+	if id != node.ID || node.identities.len() > 0 {
+		node.identities.present(addr, id)
+	}
+}
+
+// replyID returns the ID to answer query from addr with: the one the
+// remote knows us by, else the identity closest to what the query is
+// about. get_peers is answered with a neighbor ID of the infohash, which
+// makes the remote likely to announce to us.
+func (node *Node) replyID(query *KRPCQuery, addr *net.UDPAddr) NodeID {
+	if id, ok := node.identities.presentedTo(addr); ok {
+		return id
+	}
+
+	switch query.Q {
+	case FindNodeType:
+		return node.closestIdentity(query.TargetNID[:])
+	case GetPeersType:
+		if len(query.InfoHash) != NodeIDBytes {
+			return node.ID
+		}
+		return GetNeighborNID(node.closestIdentity(query.InfoHash), query.InfoHash)
+	case AnnouncePeerType:
+		return node.closestIdentity(query.InfoHash)
+	default:
+		return node.closestIdentity(query.NID[:])
+	}
+}
+
+// refreshIdentities looks up the IDs of the identities, through their own
+// tables or through the node's table while they are empty.
+func (node *Node) refreshIdentities() {
+	for _, ident := range node.identities.all() {
+		contacts := ident.table.Closest(table.Hash(ident.id), 8).Entries()
+		if len(contacts) == 0 {
+			contacts = node.table.Closest(table.Hash(ident.id), 8).Entries()
+		}
+		for _, contact := range contacts {
+			node.findNodeAs(&contact.UDPAddr, ident.id, ident.id)
+		}
+	}
+}
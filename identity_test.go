@@ -0,0 +1,144 @@
+package dht
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bttown/routing-table"
+)
+
+func TestIdentities(t *testing.T) {
+	node := NewNode(OptionDumpFile(""))
+	ids := SpreadNodeIDs(4)
+	for i, id := range ids {
+		if id[0] != byte(i*64) {
+			t.Errorf("id %d starts with %x, want %x", i, id[0], i*64)
+		}
+		if err := node.AddIdentity(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := node.AddIdentity(ids[0]); err != ErrIdentityExists {
+		t.Errorf("got %v adding an identity twice", err)
+	}
+	if err := node.AddIdentity(node.ID); err != ErrIdentityExists {
+		t.Errorf("got %v adding the node ID", err)
+	}
+
+	if !node.RemoveIdentity(ids[1]) || node.RemoveIdentity(ids[1]) || node.RemoveIdentity(node.ID) {
+		t.Error("unexpected result removing identities")
+	}
+	got := node.Identities()
+	if len(got) != 4 || got[0] != node.ID || got[2] != ids[2] {
+		t.Errorf("unexpected identities %x", got)
+	}
+
+	target := ids[3]
+	target[19] ^= 1
+	if id := node.closestIdentity(target[:]); id != ids[3] {
+		t.Errorf("closest identity %x, want %x", id, ids[3])
+	}
+}
+
+func TestReplyWithPresentedID(t *testing.T) {
+	ids := SpreadNodeIDs(2)
+	node := newTestNode(t, OptionIdentities(ids...))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	// the remote only knows us as ids[1] after we queried it as ids[1]
+	if err := node.findNodeAs(addr, ids[1], GenerateNodeID()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewKRPCMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := new(KRPCQuery)
+	query.Loads(msg.data)
+	if query.NID != ids[1] {
+		t.Fatalf("queried as %x, want %x", query.NID, ids[1])
+	}
+
+	ping, err := (&KRPCQuery{T: []byte("aa"), Q: PingType, NID: GenerateNodeID()}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(ping, node.LocalAddr())
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no ping response:", err)
+		}
+		if messageType(buf[:n]) != "r" {
+			continue
+		}
+		r := new(KRPCResponse)
+		msg, _ := NewKRPCMessage(buf[:n])
+		r.Loads(msg.data)
+		if r.QueriedID != ids[1] {
+			t.Errorf("answered as %x, want %x", r.QueriedID, ids[1])
+		}
+		break
+	}
+}
+
+func TestOptionIdentitiesInvalid(t *testing.T) {
+	id := GenerateNodeID()
+	for _, opts := range [][]NodeOption{
+		{OptionIdentities(id, id)},
+		{OptionIdentities(id), OptionNodeID(hex.EncodeToString(id[:]))},
+	} {
+		node := NewNode(testNodeOptions(opts...)...)
+		if err := node.Start(context.Background()); err != ErrIdentityExists {
+			node.Shutdown(context.Background())
+			t.Errorf("got %v, want ErrIdentityExists", err)
+		}
+	}
+}
+
+func TestBoundElsewhereInIdentityTable(t *testing.T) {
+	ids := SpreadNodeIDs(1)
+	node := NewNode(OptionDumpFile(""), OptionIdentities(ids...))
+	defer node.Shutdown(context.Background())
+
+	id := GenerateNodeID()
+	known := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	node.tableFor(ids[0]).Update(&table.Contact{UDPAddr: *known, NID: table.Hash(id)})
+
+	if node.boundElsewhere(id, known) {
+		t.Error("known address reported as another one")
+	}
+	if !node.boundElsewhere(id, &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 6881}) {
+		t.Error("ID bound in an identity's table not detected")
+	}
+}
+
+func TestServeRefusesIDOptions(t *testing.T) {
+	node := NewNode(testNodeOptions()...)
+	id := node.ID
+
+	if err := node.Serve(OptionIdentities(GenerateNodeID())); err != ErrServeOption {
+		t.Errorf("got %v for OptionIdentities, want ErrServeOption", err)
+	}
+	if err := node.Serve(OptionNodeID(RANDOM)); err != ErrServeOption {
+		t.Errorf("got %v for OptionNodeID, want ErrServeOption", err)
+	}
+	if node.ID != id || len(node.Identities()) != 1 || node.fixedID {
+		t.Error("refused options changed the node")
+	}
+}
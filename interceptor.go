@@ -0,0 +1,39 @@
+package dht
+
+import (
+	"net"
+)
+
+// Message is a received query or response, decoded. Exactly one of Query
+// and Response is set. The Q of a response is the method of the query it
+// answers.
+type Message struct {
+	Query    *KRPCQuery
+	Response *KRPCResponse
+}
+
+// MessageHandler handles a received message.
+type MessageHandler func(msg *Message, remote *net.UDPAddr) error
+
+// Interceptor wraps the handling of the queries that passed the rate
+// limits and of the responses to our queries, see OptionInterceptors. It
+// can inspect or rewrite msg before calling next, or not call next to drop
+// the message. A query is answered with a KRPC error when the interceptor
+// returns one, such as KRPCErrProtocol. The message and its byte slices
+// must not be kept after the interceptor returned.
+//
+// KRPC error messages answering our queries do not go through the
+// interceptors, they are reported to EventHandler.OnError.
+type Interceptor func(msg *Message, remote *net.UDPAddr, next MessageHandler) error
+
+// intercept runs msg through the node's interceptors, the first one
+// outermost, and then through h.
+func (node *Node) intercept(msg *Message, remote *net.UDPAddr, h MessageHandler) error {
+	for i := len(node.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := node.interceptors[i], h
+		h = func(msg *Message, remote *net.UDPAddr) error {
+			return interceptor(msg, remote, next)
+		}
+	}
+	return h(msg, remote)
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) Interceptor {
+		return func(msg *Message, remote *net.UDPAddr, next MessageHandler) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return next(msg, remote)
+		}
+	}
+	calls := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), order...)
+	}
+	reject := func(msg *Message, remote *net.UDPAddr, next MessageHandler) error {
+		if msg.Query != nil && msg.Query.Q == GetPeersType {
+			return KRPCErrProtocol
+		}
+		// drop the responses
+		if msg.Response != nil {
+			return nil
+		}
+		return next(msg, remote)
+	}
+	node := newTestNode(t, OptionInterceptors(record("first"), record("second"), reject))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a ping goes through and the node pings back to verify us
+	ping, _ := (&KRPCQuery{T: []byte("aa"), Q: PingType, NID: GenerateNodeID()}).Encode()
+	conn.WriteTo(ping, node.LocalAddr())
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var probe, reply *KRPCMessage
+	for probe == nil || reply == nil {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no ping response and verification ping:", err)
+		}
+		msg, err := NewKRPCMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.IsQuery() {
+			probe = msg
+		} else {
+			reply = msg
+		}
+	}
+	if got := calls(); len(got) != 2 || got[0] != "first" || got[1] != "second" {
+		t.Errorf("interceptors ran in order %v", got)
+	}
+
+	query, _ := (&KRPCQuery{T: []byte("bb"), Q: GetPeersType, NID: GenerateNodeID(), InfoHash: make([]byte, 20)}).Encode()
+	conn.WriteTo(query, node.LocalAddr())
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("no error reply:", err)
+	}
+	e, err := bencode.Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := e.(map[string]interface{})
+	if string(msg["y"].([]byte)) != "e" || msg["e"].([]interface{})[0].(int64) != 203 {
+		t.Errorf("got %v, want a 203 error", msg)
+	}
+
+	resp, _ := (&KRPCResponse{T: []byte(probe.T), Q: PingType, QueriedID: GenerateNodeID()}).Encode()
+	conn.WriteTo(resp, node.LocalAddr())
+	deadline := time.Now().Add(5 * time.Second)
+	for len(calls()) < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := calls(); len(got) != 6 {
+		t.Errorf("response did not go through the interceptors: %v", got)
+	}
+	if len(node.Contacts()) != 0 {
+		t.Error("dropped response was processed")
+	}
+}
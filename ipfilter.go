@@ -0,0 +1,273 @@
+package dht
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrIPFiltered is returned when a packet is not sent because the
+// destination is blocked by the IP filter.
+var ErrIPFiltered = errors.New("address blocked by the IP filter")
+
+// bogons are the address ranges that are never routable on the
+// internet: private, loopback, link local, multicast, documentation and
+// reserved networks.
+var bogons = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+var bogonNets = func() []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(bogons))
+	for _, s := range bogons {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// IsBogon reports whether ip is in one of the ranges that are never
+// routable on the internet.
+func IsBogon(ip net.IP) bool {
+	for _, n := range bogonNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipRange is an inclusive range of IPv4 addresses.
+type ipRange struct {
+	first, last uint32
+}
+
+// IPFilter blocks bogon addresses and the IPv4 ranges of blocklists.
+// Blocked addresses are never queried, answered or added to the routing
+// table. It is safe for concurrent use, blocklists can be reloaded while
+// the node is running.
+type IPFilter struct {
+	dropped uint64
+
+	bogons bool
+	mu     sync.RWMutex
+	ranges []ipRange
+}
+
+// IPFilterStats reports the size of an IP filter and how many packets and
+// contacts it dropped.
+type IPFilterStats struct {
+	Ranges  int
+	Dropped uint64
+}
+
+// NewIPFilter returns a filter without blocklists, blocking bogon
+// addresses if bogons is set.
+func NewIPFilter(bogons bool) *IPFilter {
+	return &IPFilter{bogons: bogons}
+}
+
+// Blocked reports whether ip is blocked.
+func (f *IPFilter) Blocked(ip net.IP) bool {
+	if f.bogons && IsBogon(ip) {
+		return true
+	}
+
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	v := ipv4ToUint(ip4)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return f.ranges[i].last >= v
+	})
+	return i < len(f.ranges) && f.ranges[i].first <= v
+}
+
+// Load replaces the blocklist with the ranges read from r, see LoadFiles.
+func (f *IPFilter) Load(r io.Reader) error {
+	ranges, err := parseBlocklist(r, nil)
+	if err != nil {
+		return err
+	}
+	f.setRanges(ranges)
+	return nil
+}
+
+// LoadFiles replaces the blocklist with the ranges of the given files, in
+// eMule ipfilter.dat format:
+//
+//	001.009.096.105 - 001.009.096.105 , 000 , Description
+//
+// or in P2P plaintext format:
+//
+//	Description:1.9.96.105-1.9.96.105
+//
+// Ranges of ipfilter.dat with an access level above 127 are allowed and
+// skipped, as are comments and malformed lines. If a file cannot be read,
+// the current blocklist is kept.
+func (f *IPFilter) LoadFiles(filenames ...string) error {
+	var ranges []ipRange
+	for _, filename := range filenames {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		ranges, err = parseBlocklist(file, ranges)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	f.setRanges(ranges)
+	return nil
+}
+
+// Stats returns the number of ranges in the blocklist and of the packets
+// and contacts dropped so far.
+func (f *IPFilter) Stats() IPFilterStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return IPFilterStats{
+		Ranges:  len(f.ranges),
+		Dropped: atomic.LoadUint64(&f.dropped),
+	}
+}
+
+// setRanges sorts and merges ranges and makes them the blocklist.
+func (f *IPFilter) setRanges(ranges []ipRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && uint64(r.first) <= uint64(merged[n-1].last)+1 {
+			if r.last > merged[n-1].last {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	f.mu.Lock()
+	f.ranges = merged
+	f.mu.Unlock()
+}
+
+func parseBlocklist(r io.Reader, ranges []ipRange) ([]ipRange, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if r, ok := parseBlocklistLine(scanner.Text()); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, scanner.Err()
+}
+
+func parseBlocklistLine(line string) (ipRange, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+		return ipRange{}, false
+	}
+
+	var span string
+	if fields := strings.Split(line, ","); len(fields) >= 2 && strings.Contains(fields[0], "-") {
+		// ipfilter.dat
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil || level > 127 {
+			return ipRange{}, false
+		}
+		span = fields[0]
+	} else if i := strings.LastIndex(line, ":"); i >= 0 {
+		// P2P plaintext
+		span = line[i+1:]
+	} else {
+		return ipRange{}, false
+	}
+
+	ends := strings.Split(span, "-")
+	if len(ends) != 2 {
+		return ipRange{}, false
+	}
+	first, ok1 := parseIPv4(ends[0])
+	last, ok2 := parseIPv4(ends[1])
+	if !ok1 || !ok2 || first > last {
+		return ipRange{}, false
+	}
+	return ipRange{first, last}, true
+}
+
+// parseIPv4 parses a dotted IPv4 address, allowing the zero padded
+// octets of ipfilter.dat that net.ParseIP rejects.
+func parseIPv4(s string) (uint32, bool) {
+	octets := strings.Split(strings.TrimSpace(s), ".")
+	if len(octets) != 4 {
+		return 0, false
+	}
+	var v uint32
+	for _, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return 0, false
+		}
+		v = v<<8 | uint32(n)
+	}
+	return v, true
+}
+
+func ipv4ToUint(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+// blocked reports whether addr must be ignored: its port is zero or the
+// IP filter blocks it. Blocked addresses are counted as dropped.
+func (node *Node) blocked(addr *net.UDPAddr) bool {
+	if addr.Port == 0 {
+		return true
+	}
+	if node.ipFilter == nil || !node.ipFilter.Blocked(addr.IP) {
+		return false
+	}
+	atomic.AddUint64(&node.ipFilter.dropped, 1)
+	return true
+}
+
+// IPFilter returns the node's IP filter, nil if filtering is disabled.
+// Reload its blocklists with LoadFiles while the node is running.
+func (node *Node) IPFilter() *IPFilter {
+	return node.ipFilter
+}
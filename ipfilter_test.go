@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBlocklist = `# comment
+001.009.096.105 - 001.009.096.110 , 000 , Some ISP
+002.000.000.000 - 002.000.000.255 , 200 , Allowed
+Spammer:3.3.3.0-3.3.3.255
+Overlap:3.3.3.128-3.3.4.10
+not a range
+`
+
+func TestIPFilter(t *testing.T) {
+	f := NewIPFilter(true)
+	if err := f.Load(strings.NewReader(testBlocklist)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"1.9.96.104", false},
+		{"1.9.96.105", true},
+		{"1.9.96.110", true},
+		{"2.0.0.1", false},
+		{"3.3.3.0", true},
+		{"3.3.4.10", true},
+		{"3.3.4.11", false},
+		{"8.8.8.8", false},
+		{"10.1.2.3", true},
+		{"127.0.0.1", true},
+		{"224.0.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"2a00:1450::1", false},
+	}
+	for _, test := range tests {
+		if got := f.Blocked(net.ParseIP(test.ip)); got != test.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", test.ip, got, test.blocked)
+		}
+	}
+
+	if n := f.Stats().Ranges; n != 2 {
+		t.Errorf("%d ranges after merging, want 2", n)
+	}
+}
+
+func TestIPFilterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "ipfilter.dat")
+	if err := ioutil.WriteFile(filename, []byte("Bad:5.5.5.5-5.5.5.5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewIPFilter(false)
+	if err := f.LoadFiles(filename); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Blocked(net.ParseIP("5.5.5.5")) {
+		t.Error("range of the file is not blocked")
+	}
+
+	if err := f.LoadFiles(filepath.Join(dir, "missing.dat")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+	if !f.Blocked(net.ParseIP("5.5.5.5")) {
+		t.Error("failed reload dropped the current blocklist")
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("Bad:6.6.6.6-6.6.6.6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.LoadFiles(filename); err != nil {
+		t.Fatal(err)
+	}
+	if f.Blocked(net.ParseIP("5.5.5.5")) || !f.Blocked(net.ParseIP("6.6.6.6")) {
+		t.Error("blocklist was not replaced")
+	}
+}
+
+func TestNodeIPFilter(t *testing.T) {
+	node := newTestNode(t, OptionIPFilter(NewIPFilter(true)))
+
+	if err := node.Ping(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 6881}); err != ErrIPFiltered {
+		t.Errorf("got %v for a private address, want ErrIPFiltered", err)
+	}
+	if err := node.Ping(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 0}); err != ErrIPFiltered {
+		t.Errorf("got %v for port 0, want ErrIPFiltered", err)
+	}
+	if n := node.IPFilter().Stats().Dropped; n != 1 {
+		t.Errorf("%d packets dropped by the filter, want 1", n)
+	}
+}
@@ -1,9 +1,10 @@
 package dht
 
 import (
-	"encoding/hex"
 	"net"
 	// "log"
+
+	"github.com/bttown/routing-table"
 )
 
 // Ping is the most basic query. "q" = "ping" A ping query has a single argument,
@@ -19,21 +20,20 @@ func (node *Node) Ping(addr *net.UDPAddr) error {
 		NID: node.ID,
 	}
 
-	data, err := req.Encode()
-	if err != nil {
-		return err
-	}
-
-	// log.Printf("send ping query to %s:%d\n", addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.sendQuery(addr, &req)
 }
 
 // response: {"id" : "<queried nodes id>"}
-func (node *Node) onPingQuery(query *KRPCQuery, addr *net.UDPAddr) error {
+func (node *Node) onPingQuery(conn net.PacketConn, query *KRPCQuery, addr *net.UDPAddr, self NodeID) error {
+	if node.observed() {
+		e := PingEvent{Node: newNodeInfo(query.NID, addr), Query: cloneQuery(query)}
+		node.emit(func(h EventHandler) { h.OnPing(e) })
+	}
+
 	response := KRPCResponse{
-		T:         node.tokenManager.GenToken(),
+		T:         query.T,
 		Q:         PingType,
-		QueriedID: node.ID,
+		QueriedID: self,
 	}
 	data, err := response.Encode()
 	if err != nil {
@@ -41,7 +41,7 @@ func (node *Node) onPingQuery(query *KRPCQuery, addr *net.UDPAddr) error {
 	}
 
 	// log.Printf("send %v response to %s:%d\n", response, addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.writeTo(conn, addr, data)
 }
 
 // FindNode is used to find the contact information for a node given its ID.
@@ -54,37 +54,33 @@ func (node *Node) onPingQuery(query *KRPCQuery, addr *net.UDPAddr) error {
 // arguments:  {"id" : "<querying nodes id>", "target" : "<id of target node>"}
 // http://www.bittorrent.org/beps/bep_0005.html#find-node
 func (node *Node) FindNode(addr *net.UDPAddr, nid NodeID) error {
+	return node.findNodeAs(addr, node.ID, nid)
+}
+
+// findNodeAs sends find_node presenting the node ID id.
+func (node *Node) findNodeAs(addr *net.UDPAddr, id, target NodeID) error {
 	req := KRPCQuery{
 		T:         node.tokenManager.GenToken(),
 		Q:         FindNodeType,
-		NID:       node.ID,
-		TargetNID: nid,
-	}
-
-	data, err := req.Encode()
-	if err != nil {
-		log.Println(err)
-		return err
+		NID:       id,
+		TargetNID: target,
 	}
 
-	// log.Printf("send find_node query to %s:%d\n", addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.sendQuery(addr, &req)
 }
 
 // response: {"id" : "<queried nodes id>", "nodes" : "<compact node info>"}
-func (node *Node) onFindNodeQuery(query *KRPCQuery, addr *net.UDPAddr) error {
-	// var nodes = make([]*NodeInfo, 0, 8)
-	// for i := 0; i < 8; i++ {
-	// 	nodes = append(nodes, &NodeInfo{
-	// 		ID:      GetNeighborNID(node.ID, query.TargetNID),
-	// 		UDPAddr: node.UDPAddr,
-	// 	})
-	// }
+func (node *Node) onFindNodeQuery(conn net.PacketConn, query *KRPCQuery, addr *net.UDPAddr, self NodeID) error {
+	if node.observed() {
+		e := FindNodeEvent{Node: newNodeInfo(query.NID, addr), Target: query.TargetNID, Query: cloneQuery(query)}
+		node.emit(func(h EventHandler) { h.OnFindNode(e) })
+	}
+
 	response := KRPCResponse{
 		T:         query.T,
 		Q:         FindNodeType,
-		QueriedID: node.ID,
-		Nodes:     make([]*NodeInfo, 0),
+		QueriedID: self,
+		Nodes:     node.closestNodes(self, query.TargetNID[:], addr),
 	}
 	data, err := response.Encode()
 	if err != nil {
@@ -92,7 +88,24 @@ func (node *Node) onFindNodeQuery(query *KRPCQuery, addr *net.UDPAddr) error {
 	}
 
 	// log.Printf("send %v response to %s:%d\n", response, addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.writeTo(conn, addr, data)
+}
+
+// closestNodes returns the IPv4 contacts of the routing table of self
+// closest to target, the querying node at addr left out, for the "nodes"
+// of a find_node or get_peers response.
+func (node *Node) closestNodes(self NodeID, target []byte, addr *net.UDPAddr) []*NodeInfo {
+	var hash table.Hash
+	copy(hash[:], target)
+
+	nodes := make([]*NodeInfo, 0, 8)
+	for _, contact := range node.tableFor(self).Closest(hash, 8).Entries() {
+		if contact.UDPAddr.IP.To4() == nil || contact.UDPAddr.String() == addr.String() {
+			continue
+		}
+		nodes = append(nodes, &NodeInfo{ID: NodeID(contact.NID), UDPAddr: contact.UDPAddr})
+	}
+	return nodes
 }
 
 // GetPeers gets peers associated with a torrent infohash. "q" = "get_peers" A get_peers
@@ -108,33 +121,30 @@ func (node *Node) onFindNodeQuery(query *KRPCQuery, addr *net.UDPAddr) error {
 // arguments:  {"id" : "<querying nodes id>", "info_hash" : "<20-byte infohash of target torrent>"}
 // http://www.bittorrent.org/beps/bep_0005.html#get-peers
 func (node *Node) GetPeers(addr *net.UDPAddr, infoHash []byte) error {
-	rid := GenerateNodeID()
 	query := KRPCQuery{
 		T:        node.tokenManager.GenToken(),
+		Q:        GetPeersType,
 		NID:      node.ID,
-		InfoHash: rid[:],
-	}
-
-	data, err := query.Encode()
-	if err != nil {
-		return err
+		InfoHash: infoHash,
 	}
 
-	// log.Printf("send find_node query to %s:%d\n", addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.sendQuery(addr, &query)
 }
 
 // response: {"id" : "<queried nodes id>", "token" :"<opaque write token>", "values" : ["<peer 1 info string>", "<peer 2 info string>"]}
-func (node *Node) onGetPeersQuery(query *KRPCQuery, addr *net.UDPAddr) error {
-	if len(query.InfoHash) == 0 {
-		query.InfoHash = generateBytes()
+func (node *Node) onGetPeersQuery(conn net.PacketConn, query *KRPCQuery, addr *net.UDPAddr, self NodeID) error {
+	if node.observed() {
+		q := cloneQuery(query)
+		e := GetPeersEvent{Node: newNodeInfo(query.NID, addr), InfoHash: q.InfoHash, Query: q}
+		node.emit(func(h EventHandler) { h.OnGetPeers(e) })
 	}
+
 	response := KRPCResponse{
 		T:         query.T,
 		Q:         GetPeersType,
-		QueriedID: GetNeighborNID(node.ID, query.InfoHash),
-		Token:     string(query.InfoHash[:2]),
-		Nodes:     make([]*NodeInfo, 0),
+		QueriedID: self,
+		Token:     node.writeTokens.issue(addr.IP),
+		Nodes:     node.closestNodes(self, query.InfoHash, addr),
 	}
 
 	data, err := response.Encode()
@@ -143,7 +153,7 @@ func (node *Node) onGetPeersQuery(query *KRPCQuery, addr *net.UDPAddr) error {
 	}
 
 	// log.Printf("send %s response to %s:%d\n", string(data), addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.writeTo(conn, addr, data)
 }
 
 // AnnouncePeer announces that the peer, controlling the querying node, is downloading a torrent on a port.
@@ -170,30 +180,38 @@ func (node *Node) AnnouncePeer(addr *net.UDPAddr, infoHash []byte, token string,
 		Port:        port,
 	}
 
-	data, err := req.Encode()
-	if err != nil {
-		return err
-	}
-
-	return node.writeToUDP(addr, data)
+	return node.sendQuery(addr, &req)
 }
 
 // response: {"id" : "<queried nodes id>"}
-func (node *Node) onAnnouncePeer(query *KRPCQuery, addr *net.UDPAddr) error {
+func (node *Node) onAnnouncePeer(conn net.PacketConn, query *KRPCQuery, addr *net.UDPAddr, self NodeID) error {
+	validToken := node.writeTokens.valid(query.Token, addr.IP)
+	if !validToken {
+		node.penalize(addr, OffenseInvalidToken)
+		if node.scores.policy.RejectInvalidTokens {
+			data, err := encodeKRPCError(query.T, &KRPCError{Code: KRPCErrProtocol.Code, Message: "bad token"})
+			if err != nil {
+				return err
+			}
+			return node.writeTo(conn, addr, data)
+		}
+	}
 
 	port := query.Port
 	if query.ImpliedPort == 1 {
 		port = addr.Port
 	}
 
-	node.PeerHandler(addr.IP.String(), port,
-		hex.EncodeToString(query.InfoHash),
-		hex.EncodeToString(query.NID[:]))
+	if node.observed() {
+		q := cloneQuery(query)
+		e := AnnounceEvent{Node: newNodeInfo(query.NID, addr), InfoHash: q.InfoHash, Port: port, ValidToken: validToken, Query: q}
+		node.emit(func(h EventHandler) { h.OnAnnounce(e) })
+	}
 
 	response := KRPCResponse{
 		T:         query.T,
 		Q:         AnnouncePeerType,
-		QueriedID: node.ID,
+		QueriedID: self,
 	}
 	data, err := response.Encode()
 	if err != nil {
@@ -201,5 +219,5 @@ func (node *Node) onAnnouncePeer(query *KRPCQuery, addr *net.UDPAddr) error {
 	}
 
 	// log.Printf("send %v response to %s:%d\n", response, addr.IP.String(), addr.Port)
-	return node.writeToUDP(addr, data)
+	return node.writeTo(conn, addr, data)
 }
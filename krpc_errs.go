@@ -4,29 +4,42 @@ import (
 	"fmt"
 )
 
-var (
-	// KRPCErrGeneric ...
-	KRPCErrGeneric = newKRPCError(201, "A Generic Error Ocurred")
-	// KRPCErrServer ...
-	KRPCErrServer = newKRPCError(201, "A Server Error Ocurred")
-	// KPRCErrProtocol ...
-	KPRCErrProtocol = newKRPCError(203, "A Protocol Error Ocurred")
-	// KPRCErrMalformedPacket ...
-	KPRCErrMalformedPacket = newKRPCError(203, "A Protocol Error Ocurred")
-	// KRPCErrMethodUnknown ...
-	KRPCErrMethodUnknown = newKRPCError(204, "Method Unknown")
-)
-
-type krpcError struct {
-	Code        int
-	Description string
-	s           string
+// KRPCError is a KRPC error message, received from a remote or sent in
+// answer to a query. Errors returned for the queries sent by the node can
+// be inspected with errors.As, and compared to the sentinels below with
+// errors.Is, which matches the code only.
+type KRPCError struct {
+	Code    int
+	Message string
 }
 
-func (err *krpcError) Error() string {
-	return err.s
+func (err *KRPCError) Error() string {
+	return fmt.Sprintf("<%d>%s", err.Code, err.Message)
 }
 
-func newKRPCError(code int, desc string) error {
-	return &krpcError{Code: code, Description: desc, s: fmt.Sprintf("<%d>%s", code, desc)}
+// Is reports whether target is a *KRPCError with the same code.
+func (err *KRPCError) Is(target error) bool {
+	t, ok := target.(*KRPCError)
+	return ok && t.Code == err.Code
 }
+
+var (
+	// KRPCErrGeneric is error 201.
+	KRPCErrGeneric = &KRPCError{Code: 201, Message: "A Generic Error Ocurred"}
+	// KRPCErrServer is error 202.
+	KRPCErrServer = &KRPCError{Code: 202, Message: "A Server Error Ocurred"}
+	// KRPCErrProtocol is error 203, such as a malformed packet, an
+	// invalid argument or a bad token.
+	KRPCErrProtocol = &KRPCError{Code: 203, Message: "A Protocol Error Ocurred"}
+	// KRPCErrMethodUnknown is error 204.
+	KRPCErrMethodUnknown = &KRPCError{Code: 204, Message: "Method Unknown"}
+
+	// KPRCErrProtocol is KRPCErrProtocol.
+	//
+	// Deprecated: use KRPCErrProtocol.
+	KPRCErrProtocol = KRPCErrProtocol
+	// KPRCErrMalformedPacket is KRPCErrProtocol.
+	//
+	// Deprecated: use KRPCErrProtocol.
+	KPRCErrMalformedPacket = KRPCErrProtocol
+)
@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestLoadKRPCErrorMsg(t *testing.T) {
+	err := LoadKRPCErrorMsg(map[string]interface{}{
+		"e": []interface{}{int64(203), []byte("bad token")},
+	})
+	var kerr *KRPCError
+	if !errors.As(err, &kerr) || kerr.Code != 203 || kerr.Message != "bad token" {
+		t.Fatalf("got %v", err)
+	}
+	if !errors.Is(err, KRPCErrProtocol) || errors.Is(err, KRPCErrServer) {
+		t.Error("errors.Is does not match by code")
+	}
+	for _, data := range []map[string]interface{}{
+		{},
+		{"e": []byte("oops")},
+		{"e": []interface{}{}},
+		{"e": []interface{}{[]byte("201")}},
+		{"e": []interface{}{int64(201), int64(0)}},
+	} {
+		if err := LoadKRPCErrorMsg(data); !errors.Is(err, KRPCErrProtocol) {
+			t.Errorf("got %v for %v, want a protocol error", err, data)
+		}
+	}
+}
+
+func TestCallErrors(t *testing.T) {
+	policy := DefaultBanPolicy
+	policy.RejectInvalidTokens = true
+	server := newTestNode(t, OptionBanPolicy(policy))
+	client := newTestNode(t)
+	addr := server.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Call(ctx, addr, &KRPCQuery{
+		Q:        AnnouncePeerType,
+		InfoHash: make([]byte, 20),
+		Port:     6881,
+		Token:    "forged",
+	})
+	var kerr *KRPCError
+	if !errors.As(err, &kerr) || kerr.Code != 203 || kerr.Message != "bad token" {
+		t.Errorf("got %v announcing with a bad token, want error 203", err)
+	}
+
+	if _, err := client.Query(ctx, addr, "vote", nil); !errors.Is(err, KRPCErrMethodUnknown) {
+		t.Errorf("got %v for an unknown method, want error 204", err)
+	}
+}
+
+func TestCallMalformedError(t *testing.T) {
+	node := newTestNode(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := node.Call(ctx, conn.LocalAddr().(*net.UDPAddr), &KRPCQuery{Q: PingType})
+		errs <- err
+	}()
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal("no query received:", err)
+	}
+	msg, err := NewKRPCMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := bencode.Marshal(map[string]interface{}{"t": []byte(msg.T), "y": "e"})
+	conn.WriteTo(reply, node.LocalAddr())
+
+	if err := <-errs; !errors.Is(err, KRPCErrProtocol) {
+		t.Errorf("got %v for an error message without error, want a protocol error", err)
+	}
+}
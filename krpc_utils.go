@@ -60,11 +60,16 @@ type KRPCResponse struct {
 	Token     string
 	Nodes     []*NodeInfo
 	Values    []string
+
+	// Fields is the "r" dictionary as decoded. It is encoded, with "id"
+	// set to QueriedID, for methods other than the built-in ones.
+	Fields map[string]interface{}
 }
 
 func (resp *KRPCResponse) Loads(data map[string]interface{}) error {
 	resp.T = data["t"].([]byte)
 	data = data["r"].(map[string]interface{})
+	resp.Fields = data
 	if queriedID, ok := data["id"]; ok {
 		copy(resp.QueriedID[:], queriedID.([]byte))
 	}
@@ -111,7 +116,10 @@ func (resp *KRPCResponse) Encode() ([]byte, error) {
 			"id": resp.QueriedID[:],
 		}
 	default:
-		return nil, ErrUnKnowQueryType
+		if resp.Fields == nil {
+			return nil, ErrUnKnowQueryType
+		}
+		data["r"] = withID(resp.Fields, resp.QueriedID)
 	}
 	return bencode.Marshal(data)
 }
@@ -126,14 +134,58 @@ type KRPCQuery struct {
 	ImpliedPort int8
 	Port        int
 	Token       string
+
+	// Args is the "a" dictionary as decoded. It is encoded, with "id" set
+	// to NID, for methods other than the built-in ones.
+	Args map[string]interface{}
 }
 
+// LoadKRPCErrorMsg returns the error of an error message as a *KRPCError.
+// A message without a valid "e" list gives a protocol error, so an error
+// message never answers a query with a nil error.
 func LoadKRPCErrorMsg(data map[string]interface{}) error {
-	if e, ok := data["e"]; ok {
-		return errors.New(string(e.([]interface{})[1].([]byte)))
+	e, ok := data["e"].([]interface{})
+	if !ok || len(e) == 0 {
+		return errMalformedError()
+	}
+	code, ok := e[0].(int64)
+	if !ok {
+		return errMalformedError()
 	}
 
-	return nil
+	err := &KRPCError{Code: int(code)}
+	if len(e) > 1 {
+		msg, ok := e[1].([]byte)
+		if !ok {
+			return errMalformedError()
+		}
+		err.Message = string(msg)
+	}
+	return err
+}
+
+func errMalformedError() error {
+	return &KRPCError{Code: KRPCErrProtocol.Code, Message: "malformed error"}
+}
+
+// withID returns a copy of the dictionary d with "id" set to id.
+func withID(d map[string]interface{}, id NodeID) map[string]interface{} {
+	c := make(map[string]interface{}, len(d)+1)
+	for k, v := range d {
+		c[k] = v
+	}
+	c["id"] = id[:]
+	return c
+}
+
+// encodeKRPCError encodes an error message answering the query with
+// transaction id t.
+func encodeKRPCError(t []byte, e *KRPCError) ([]byte, error) {
+	return bencode.Marshal(map[string]interface{}{
+		"t": t,
+		"y": []byte("e"),
+		"e": []interface{}{int64(e.Code), []byte(e.Message)},
+	})
 }
 
 func (query *KRPCQuery) Loads(data map[string]interface{}) error {
@@ -146,6 +198,7 @@ func (query *KRPCQuery) Loads(data map[string]interface{}) error {
 	}
 
 	data = data["a"].(map[string]interface{})
+	query.Args = data
 
 	if nid, ok := data["id"]; ok {
 		copy(query.NID[:], nid.([]byte))
@@ -205,7 +258,10 @@ func (query *KRPCQuery) Encode() ([]byte, error) {
 			"token":        query.Token,
 		}
 	default:
-		return nil, ErrUnKnowQueryType
+		if query.Args == nil {
+			return nil, ErrUnKnowQueryType
+		}
+		data["a"] = withID(query.Args, query.NID)
 	}
 	return bencode.Marshal(data)
 }
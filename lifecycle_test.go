@@ -0,0 +1,85 @@
+package dht
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStartShutdown(t *testing.T) {
+	node := NewNode(OptionAddress("127.0.0.1:0"), OptionDumpFile(""))
+
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(context.Background()); err != ErrNodeRunning {
+		t.Errorf("expected ErrNodeRunning, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := node.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown returned %v", err)
+	}
+
+	select {
+	case <-node.Done():
+	default:
+		t.Error("Done was not closed")
+	}
+	if err := node.Ping(&node.localUDPAddr); err != ErrNodeClosed {
+		t.Errorf("expected ErrNodeClosed after shutdown, got %v", err)
+	}
+}
+
+func TestStartContextCancel(t *testing.T) {
+	node := NewNode(OptionAddress("127.0.0.1:0"), OptionDumpFile(""))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := node.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case <-node.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("node did not stop when its context was cancelled")
+	}
+}
+
+func TestStartRetry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dht.dat")
+	contact := &NodeInfo{ID: GenerateNodeID(), UDPAddr: net.UDPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881}}
+	b, err := EncodeTransmissionState(GenerateNodeID(), []*NodeInfo{contact})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewNode(testNodeOptions(OptionAddress(busy.LocalAddr().String()), OptionBootstrapFiles(filename))...)
+	defer node.Shutdown(context.Background())
+	if err := node.Start(context.Background()); err == nil {
+		t.Fatal("started on a busy address")
+	}
+	busy.Close()
+
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(node.bootstrapContacts); n != 1 {
+		t.Errorf("%d bootstrap contacts after a retry, want 1", n)
+	}
+}
@@ -1,12 +1,84 @@
 package dht
 
 import (
-	loglib "log"
-	"os"
+	"fmt"
+	"log"
+	"strings"
 )
 
-var log *loglib.Logger
+// Logger receives the log messages of a node, see OptionLogger. Messages
+// come with key-value pairs such as "remote", "method", "tx" and "err".
+// *slog.Logger implements it; NewStdLogger adapts a *log.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// Level is the severity of a message, with the values of the slog levels.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l >= LevelError:
+		return "ERROR"
+	case l >= LevelWarn:
+		return "WARN"
+	case l >= LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+// nopLogger discards everything, it is the logger of a node created
+// without OptionLogger.
+type nopLogger struct{}
 
-func init() {
-	log = loglib.New(os.Stderr, "[dht-node] ", loglib.Lshortfile|loglib.Ltime)
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// NewStdLogger returns a Logger that writes the messages of level or
+// above to l, one line each: "WARN save routing table err=...".
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	return &stdLogger{l: l, level: level}
 }
+
+func (s *stdLogger) log(level Level, msg string, args []interface{}) {
+	if level < s.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	s.l.Output(3, b.String())
+}
+
+func (s *stdLogger) Debug(msg string, args ...interface{}) { s.log(LevelDebug, msg, args) }
+func (s *stdLogger) Info(msg string, args ...interface{})  { s.log(LevelInfo, msg, args) }
+func (s *stdLogger) Warn(msg string, args ...interface{})  { s.log(LevelWarn, msg, args) }
+func (s *stdLogger) Error(msg string, args ...interface{}) { s.log(LevelError, msg, args) }
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+
+	l.Debug("hidden", "remote", "1.2.3.4:5")
+	l.Warn("ban", "remote", "1.2.3.4:5", "offense", OffenseFlood, "odd")
+	if got, want := buf.String(), "WARN ban remote=1.2.3.4:5 offense=flood !BADKEY=odd\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+type record struct {
+	level Level
+	msg   string
+	args  []interface{}
+}
+
+type recordLogger struct {
+	mu      sync.Mutex
+	records []record
+}
+
+func (l *recordLogger) add(level Level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record{level, msg, args})
+}
+
+func (l *recordLogger) find(msg string) *record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.records {
+		if l.records[i].msg == msg {
+			return &l.records[i]
+		}
+	}
+	return nil
+}
+
+func (l *recordLogger) Debug(msg string, args ...interface{}) { l.add(LevelDebug, msg, args) }
+func (l *recordLogger) Info(msg string, args ...interface{})  { l.add(LevelInfo, msg, args) }
+func (l *recordLogger) Warn(msg string, args ...interface{})  { l.add(LevelWarn, msg, args) }
+func (l *recordLogger) Error(msg string, args ...interface{}) { l.add(LevelError, msg, args) }
+
+func TestOptionLogger(t *testing.T) {
+	rec := &recordLogger{}
+	node := newTestNode(t, OptionLogger(rec))
+
+	r := rec.find("start node")
+	if r == nil || r.level != LevelInfo {
+		t.Fatalf("no start node message in %+v", rec.records)
+	}
+	if len(r.args) < 4 || r.args[2] != "local" {
+		t.Errorf("unexpected fields %v", r.args)
+	}
+
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	for i := 0; i < 100 && len(node.Bans()) == 0; i++ {
+		node.penalizeResponder(remote, OffenseBogusNodes)
+	}
+	r = rec.find("ban")
+	if r == nil || r.level != LevelWarn || r.args[0] != "remote" || r.args[1] != remote {
+		t.Errorf("unexpected ban message %+v", r)
+	}
+
+	if NewNode(OptionLogger(nil)).logger == nil {
+		t.Error("nil logger not replaced")
+	}
+}
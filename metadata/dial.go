@@ -0,0 +1,109 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bttown/dht/utp"
+)
+
+// utpHeadStart is how long a uTP dial gets before we also try TCP, since
+// peers behind NAT are often reachable over uTP only.
+const utpHeadStart = 500 * time.Millisecond
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Dialer connects to peers over uTP and TCP in parallel.
+type Dialer struct {
+	// UTP is the socket uTP connections are opened on, typically the one
+	// sharing the DHT node's port, see dht.Node.UTP. If nil, every dial
+	// opens a private socket on an ephemeral port.
+	UTP *utp.Socket
+}
+
+// DialPeer connects to a peer with a Dialer opening private uTP sockets.
+func DialPeer(addr string, timeout time.Duration) (net.Conn, error) {
+	return (&Dialer{}).Dial(addr, timeout)
+}
+
+// Dial connects to the peer at addr over uTP and, after utpHeadStart or
+// as soon as uTP fails, over TCP. It returns the first connection that
+// succeeds and cancels the other attempt; a loser that connected anyway
+// is closed. It can be used as Fetcher.Dial.
+func (d *Dialer) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	results := make(chan dialResult, 2)
+	utpFailed := make(chan struct{})
+
+	go func() {
+		conn, err := d.dialUTP(ctx, addr)
+		if err != nil {
+			close(utpFailed)
+			results <- dialResult{nil, err}
+			return
+		}
+		results <- dialResult{conn, nil}
+	}()
+
+	go func() {
+		timer := time.NewTimer(utpHeadStart)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-utpFailed:
+		case <-ctx.Done():
+			results <- dialResult{nil, ctx.Err()}
+			return
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		results <- dialResult{conn, err}
+	}()
+
+	var errs []error
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+
+		cancel()
+		if i == 0 {
+			go func() {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}()
+		}
+		return r.conn, nil
+	}
+	cancel()
+
+	return nil, errors.New("dial " + addr + ": " + errs[0].Error() + "; " + errs[1].Error())
+}
+
+func (d *Dialer) dialUTP(ctx context.Context, addr string) (net.Conn, error) {
+	if d.UTP == nil {
+		return utp.DialContext(ctx, "udp", addr)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.UTP.DialContext(ctx, raddr)
+}
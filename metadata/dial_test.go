@@ -0,0 +1,83 @@
+package metadata
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bttown/dht/utp"
+)
+
+func TestDialerCancelsTCPWhenUTPWins(t *testing.T) {
+	server, err := utp.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// accepted connections are reset when the server socket closes
+	go func() {
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// a TCP listener on the same port records whether TCP was dialed
+	l, err := net.Listen("tcp", server.Addr().String())
+	if err != nil {
+		t.Skip("cannot listen on the uTP port over TCP:", err)
+	}
+	defer l.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	client, err := utp.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	d := &Dialer{UTP: client}
+	conn, err := d.Dial(server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != client.Addr().String() {
+		t.Errorf("dialed from %v, want the shared socket %v", conn.LocalAddr(), client.Addr())
+	}
+
+	select {
+	case <-accepted:
+		t.Error("TCP was dialed although uTP connected first")
+	case <-time.After(2 * utpHeadStart):
+	}
+}
+
+func TestDialerFallsBackToTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	conn, err := DialPeer(l.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("got a %T, want a TCP connection", conn)
+	}
+}
@@ -0,0 +1,228 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+// extended message ids we advertise in our extension handshake
+const (
+	utMetadataID = 1
+	utPexID      = 2
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// MaxMetadataSize bounds the metadata_size we accept from a peer.
+const MaxMetadataSize = 10 << 20
+
+var (
+	ErrNoMetadata        = errors.New("metadata: peer does not support ut_metadata")
+	ErrBadMetadataSize   = errors.New("metadata: invalid metadata_size")
+	ErrRejected          = errors.New("metadata: piece request rejected")
+	ErrMetadataCorrupted = errors.New("metadata: sha1 does not match info hash")
+)
+
+// PeerHandler receives peers learned through Peer Exchange.
+type PeerHandler func(infoHash []byte, added, dropped []Peer)
+
+// Fetcher downloads the info dictionary of a torrent from a single peer.
+type Fetcher struct {
+	// PeerID is sent in the handshake, a random one is used if empty.
+	PeerID []byte
+	// Timeout bounds dialing and the whole exchange with a peer.
+	Timeout time.Duration
+	// Dial connects to a peer, DialPeer by default. Use the Dial method
+	// of a Dialer to open uTP connections on the DHT node's socket.
+	Dial func(addr string, timeout time.Duration) (net.Conn, error)
+	// OnPeers, if set, is called with peers learned from ut_pex messages
+	// received while fetching.
+	OnPeers PeerHandler
+}
+
+// Fetch connects to the peer at addr and returns the raw, verified info
+// dictionary of the torrent identified by infoHash.
+func (f *Fetcher) Fetch(ctx context.Context, infoHash []byte, addr string) ([]byte, error) {
+	return f.fetch(ctx, infoHash, addr, f.OnPeers)
+}
+
+func (f *Fetcher) fetch(ctx context.Context, infoHash []byte, addr string, onPeers PeerHandler) ([]byte, error) {
+	timeout := f.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	dial := f.Dial
+	if dial == nil {
+		dial = DialPeer
+	}
+
+	conn, err := dial(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	peerID := f.PeerID
+	if len(peerID) == 0 {
+		peerID = make([]byte, 20)
+		rand.Read(peerID)
+	}
+
+	b, err := f.exchange(conn, infoHash, peerID, onPeers)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return b, err
+}
+
+func (f *Fetcher) exchange(conn net.Conn, infoHash, peerID []byte, onPeers PeerHandler) ([]byte, error) {
+	if _, err := conn.Write(handshake(infoHash, peerID)); err != nil {
+		return nil, err
+	}
+	reserved, hash, err := readHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hash, infoHash) {
+		return nil, ErrInfoHashMismatch
+	}
+	if !supportsExtensions(reserved) {
+		return nil, ErrNoExtensions
+	}
+
+	ext, _ := bencode.Marshal(map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": utMetadataID,
+			"ut_pex":      utPexID,
+		},
+	})
+	if err := writeExtended(conn, extHandshake, ext); err != nil {
+		return nil, err
+	}
+
+	var (
+		metadata   []byte
+		pieces     []bool
+		remaining  int
+		remoteMeta int
+	)
+
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if id != msgExtended || len(payload) == 0 {
+			continue
+		}
+
+		switch payload[0] {
+		case extHandshake:
+			if metadata != nil {
+				continue
+			}
+			dict, _, err := decodeDict(payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			m, _ := dict["m"].(map[string]interface{})
+			remoteMeta, _ = toInt(m["ut_metadata"])
+			if remoteMeta <= 0 || remoteMeta > 255 {
+				return nil, ErrNoMetadata
+			}
+			size, _ := toInt(dict["metadata_size"])
+			if size <= 0 || size > MaxMetadataSize {
+				return nil, ErrBadMetadataSize
+			}
+
+			metadata = make([]byte, size)
+			remaining = (size + PieceSize - 1) / PieceSize
+			pieces = make([]bool, remaining)
+			for i := 0; i < remaining; i++ {
+				req, _ := bencode.Marshal(map[string]interface{}{
+					"msg_type": metadataRequest,
+					"piece":    i,
+				})
+				if err := writeExtended(conn, byte(remoteMeta), req); err != nil {
+					return nil, err
+				}
+			}
+
+		case utMetadataID:
+			if metadata == nil {
+				continue
+			}
+			dict, data, err := decodeDict(payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			msgType, _ := toInt(dict["msg_type"])
+			piece, ok := toInt(dict["piece"])
+			if !ok || piece < 0 || piece >= len(pieces) {
+				return nil, ErrBadMessage
+			}
+
+			switch msgType {
+			case metadataReject:
+				return nil, ErrRejected
+			case metadataData:
+				if pieces[piece] {
+					continue
+				}
+				off := piece * PieceSize
+				if len(data) != pieceLength(len(metadata), piece) {
+					return nil, ErrBadMessage
+				}
+				copy(metadata[off:], data)
+				pieces[piece] = true
+				remaining--
+			}
+
+			if remaining == 0 {
+				sum := sha1.Sum(metadata)
+				if !bytes.Equal(sum[:], infoHash) {
+					return nil, ErrMetadataCorrupted
+				}
+				return metadata, nil
+			}
+
+		case utPexID:
+			if onPeers == nil {
+				continue
+			}
+			msg, err := ParsePEX(payload[1:])
+			if err != nil {
+				continue
+			}
+			if len(msg.Added) > 0 || len(msg.Dropped) > 0 {
+				onPeers(infoHash, msg.Added, msg.Dropped)
+			}
+		}
+	}
+}
+
+func pieceLength(size, piece int) int {
+	if rest := size - piece*PieceSize; rest < PieceSize {
+		return rest
+	}
+	return PieceSize
+}
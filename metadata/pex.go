@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+)
+
+// Peer is the address of a BitTorrent peer.
+type Peer struct {
+	IP   net.IP
+	Port int
+}
+
+func (p Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// ParseCompactPeers parses peers in the compact format: 6 bytes per IPv4
+// peer, or 18 bytes per IPv6 peer when ipv6 is set.
+func ParseCompactPeers(b []byte, ipv6 bool) []Peer {
+	size := net.IPv4len + 2
+	if ipv6 {
+		size = net.IPv6len + 2
+	}
+
+	peers := make([]Peer, 0, len(b)/size)
+	for i := 0; i+size <= len(b); i += size {
+		ip := make(net.IP, size-2)
+		copy(ip, b[i:i+size-2])
+		port := int(binary.BigEndian.Uint16(b[i+size-2 : i+size]))
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, Peer{IP: ip, Port: port})
+	}
+	return peers
+}
+
+// PEXMessage is a ut_pex message, BEP 11.
+type PEXMessage struct {
+	Added   []Peer
+	Dropped []Peer
+}
+
+// ParsePEX decodes the payload of a ut_pex message. The added.f flags are
+// ignored.
+func ParsePEX(b []byte) (*PEXMessage, error) {
+	dict, _, err := decodeDict(b)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(PEXMessage)
+	if v, ok := dict["added"].([]byte); ok {
+		msg.Added = append(msg.Added, ParseCompactPeers(v, false)...)
+	}
+	if v, ok := dict["added6"].([]byte); ok {
+		msg.Added = append(msg.Added, ParseCompactPeers(v, true)...)
+	}
+	if v, ok := dict["dropped"].([]byte); ok {
+		msg.Dropped = append(msg.Dropped, ParseCompactPeers(v, false)...)
+	}
+	if v, ok := dict["dropped6"].([]byte); ok {
+		msg.Dropped = append(msg.Dropped, ParseCompactPeers(v, true)...)
+	}
+	return msg, nil
+}
@@ -0,0 +1,49 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestParsePEX(t *testing.T) {
+	b, _ := bencode.Marshal(map[string]interface{}{
+		"added":   []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2},
+		"added.f": []byte{0, 0},
+		"added6": []byte{
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1,
+		},
+		"dropped": []byte{192, 168, 1, 1, 0, 80},
+	})
+
+	msg, err := ParsePEX(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Added) != 3 {
+		t.Fatalf("expected 3 added peers, got %d", len(msg.Added))
+	}
+	if s := msg.Added[0].String(); s != "10.0.0.1:6881" {
+		t.Errorf("unexpected first peer %s", s)
+	}
+	if s := msg.Added[2].String(); s != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected IPv6 peer %s", s)
+	}
+	if len(msg.Dropped) != 1 || msg.Dropped[0].Port != 80 {
+		t.Errorf("unexpected dropped peers %v", msg.Dropped)
+	}
+}
+
+func TestDecodeDictTrailingData(t *testing.T) {
+	b := append([]byte("d8:msg_typei1e5:piecei0e10:total_sizei3ee"), "abc"...)
+	dict, rest, err := decodeDict(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := toInt(dict["total_size"]); n != 3 {
+		t.Errorf("unexpected total_size %v", dict["total_size"])
+	}
+	if string(rest) != "abc" {
+		t.Errorf("unexpected trailing data %q", rest)
+	}
+}
@@ -0,0 +1,239 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+// Store holds torrent metadata keyed by info hash.
+type Store interface {
+	// Get returns the raw info dictionary of infoHash.
+	Get(infoHash []byte) ([]byte, bool)
+}
+
+// MemoryStore is a Store keeping metadata in memory.
+type MemoryStore struct {
+	mu sync.RWMutex
+	m  map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{m: make(map[string][]byte)}
+}
+
+// Add stores a raw info dictionary and returns its info hash.
+func (s *MemoryStore) Add(info []byte) []byte {
+	sum := sha1.Sum(info)
+	s.mu.Lock()
+	s.m[string(sum[:])] = info
+	s.mu.Unlock()
+	return sum[:]
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(infoHash []byte) ([]byte, bool) {
+	s.mu.RLock()
+	b, ok := s.m[string(infoHash)]
+	s.mu.RUnlock()
+	return b, ok
+}
+
+// InfoHashes returns the info hashes of every stored torrent.
+func (s *MemoryStore) InfoHashes() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hashes := make([][]byte, 0, len(s.m))
+	for h := range s.m {
+		hashes = append(hashes, []byte(h))
+	}
+	return hashes
+}
+
+// ErrProviderClosed is returned by Serve after Close.
+var ErrProviderClosed = errors.New("metadata: provider closed")
+
+// Provider serves metadata from a Store to other peers over ut_metadata.
+// It only speaks the handshake and extension protocol, peers asking for
+// anything else are ignored.
+type Provider struct {
+	Store Store
+	// PeerID is sent in the handshake, a random one is used if empty.
+	PeerID []byte
+	// Timeout bounds the lifetime of a single peer connection.
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	closed    bool
+}
+
+// NewProvider returns a provider serving metadata from store.
+func NewProvider(store Store) *Provider {
+	return &Provider{Store: store}
+}
+
+// ListenAndServe listens on the TCP address addr and serves peers.
+func (p *Provider) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return p.Serve(l)
+}
+
+// Serve accepts peer connections on l until Close is called. l can be a
+// TCP listener or a uTP socket.
+func (p *Provider) Serve(l net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		l.Close()
+		return ErrProviderClosed
+	}
+	p.listeners = append(p.listeners, l)
+	p.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return ErrProviderClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go p.serveConn(conn)
+	}
+}
+
+// Close stops every listener passed to Serve.
+func (p *Provider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.listeners = nil
+	return nil
+}
+
+func (p *Provider) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	reserved, infoHash, err := readHandshake(conn)
+	if err != nil || !supportsExtensions(reserved) {
+		return
+	}
+	info, ok := p.Store.Get(infoHash)
+	if !ok {
+		return
+	}
+
+	peerID := p.PeerID
+	if len(peerID) == 0 {
+		peerID = make([]byte, 20)
+		rand.Read(peerID)
+	}
+	if _, err := conn.Write(handshake(infoHash, peerID)); err != nil {
+		return
+	}
+
+	ext, _ := bencode.Marshal(map[string]interface{}{
+		"m": map[string]interface{}{
+			"ut_metadata": utMetadataID,
+		},
+		"metadata_size": len(info),
+	})
+	if err := writeExtended(conn, extHandshake, ext); err != nil {
+		return
+	}
+
+	var remoteMeta int
+	for {
+		id, payload, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if id != msgExtended || len(payload) == 0 {
+			continue
+		}
+
+		switch payload[0] {
+		case extHandshake:
+			dict, _, err := decodeDict(payload[1:])
+			if err != nil {
+				return
+			}
+			m, _ := dict["m"].(map[string]interface{})
+			remoteMeta, _ = toInt(m["ut_metadata"])
+			if remoteMeta <= 0 || remoteMeta > 255 {
+				return
+			}
+
+		case utMetadataID:
+			if remoteMeta == 0 {
+				return
+			}
+			if err := answerRequest(conn, byte(remoteMeta), info, payload[1:]); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// answerRequest replies to a ut_metadata request with the piece, or with
+// a reject if the piece does not exist.
+func answerRequest(conn net.Conn, extID byte, info, payload []byte) error {
+	dict, _, err := decodeDict(payload)
+	if err != nil {
+		return err
+	}
+	msgType, _ := toInt(dict["msg_type"])
+	if msgType != metadataRequest {
+		return nil
+	}
+
+	piece, ok := toInt(dict["piece"])
+	pieces := (len(info) + PieceSize - 1) / PieceSize
+	if !ok || piece < 0 || piece >= pieces {
+		msg, _ := bencode.Marshal(map[string]interface{}{
+			"msg_type": metadataReject,
+			"piece":    piece,
+		})
+		return writeExtended(conn, extID, msg)
+	}
+
+	msg, _ := bencode.Marshal(map[string]interface{}{
+		"msg_type":   metadataData,
+		"piece":      piece,
+		"total_size": len(info),
+	})
+	var b bytes.Buffer
+	b.Write(msg)
+	off := piece * PieceSize
+	b.Write(info[off : off+pieceLength(len(info), piece)])
+	return writeExtended(conn, extID, b.Bytes())
+}
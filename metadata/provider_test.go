@@ -0,0 +1,120 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestProviderServesFetcher(t *testing.T) {
+	pieces := make([]byte, 20*3000)
+	info, _ := bencode.Marshal(map[string]interface{}{
+		"name":         "test",
+		"piece length": 16384,
+		"pieces":       pieces,
+		"length":       3000 * 16384,
+	})
+
+	store := NewMemoryStore()
+	infoHash := store.Add(info)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewProvider(store)
+	go provider.Serve(l)
+	defer provider.Close()
+
+	fetcher := &Fetcher{
+		Timeout: 5 * time.Second,
+		Dial: func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, timeout)
+		},
+	}
+
+	b, err := fetcher.Fetch(context.Background(), infoHash, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, info) {
+		t.Error("fetched metadata differs from the stored one")
+	}
+
+	unknown := make([]byte, 20)
+	if _, err := fetcher.Fetch(context.Background(), unknown, l.Addr().String()); err == nil {
+		t.Error("fetching an unknown info hash succeeded")
+	}
+}
+
+func TestProviderRejectsUnknownPieces(t *testing.T) {
+	info, _ := bencode.Marshal(map[string]interface{}{"name": "test", "piece length": 16384, "pieces": make([]byte, 20), "length": 1})
+	store := NewMemoryStore()
+	infoHash := store.Add(info)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewProvider(store)
+	go provider.Serve(l)
+	defer provider.Close()
+
+	dial := func(infoHash []byte) net.Conn {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(handshake(infoHash, make([]byte, 20))); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := dial(make([]byte, 20))
+	if _, _, err := readHandshake(conn); err == nil {
+		t.Error("provider answered the handshake for an unknown info hash")
+	}
+	conn.Close()
+
+	conn = dial(infoHash)
+	defer conn.Close()
+	if _, _, err := readHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readMessage(conn); err != nil {
+		t.Fatal("no extension handshake:", err)
+	}
+	const ourID = 3
+	ext, _ := bencode.Marshal(map[string]interface{}{"m": map[string]interface{}{"ut_metadata": ourID}})
+	if err := writeExtended(conn, extHandshake, ext); err != nil {
+		t.Fatal(err)
+	}
+	request, _ := bencode.Marshal(map[string]interface{}{"msg_type": metadataRequest, "piece": 1})
+	if err := writeExtended(conn, utMetadataID, request); err != nil {
+		t.Fatal(err)
+	}
+
+	id, payload, err := readMessage(conn)
+	if err != nil {
+		t.Fatal("no answer to the request:", err)
+	}
+	if id != msgExtended || len(payload) == 0 || payload[0] != ourID {
+		t.Fatalf("got message %d %x, want a ut_metadata message", id, payload)
+	}
+	dict, _, err := decodeDict(payload[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType, _ := toInt(dict["msg_type"]); msgType != metadataReject {
+		t.Errorf("got msg_type %d for a piece out of range, want a reject", msgType)
+	}
+	if piece, _ := toInt(dict["piece"]); piece != 1 {
+		t.Errorf("reject for piece %d, want 1", piece)
+	}
+}
@@ -0,0 +1,173 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrNoPeers is returned by Resolve when every candidate failed.
+var ErrNoPeers = errors.New("metadata: no peer could provide the metadata")
+
+// Resolver fetches metadata by trying candidate peers concurrently until
+// one of them delivers it. Peers learned through Peer Exchange while
+// fetching are added to the candidates, so torrents with only a handful
+// of peers in the DHT can still be resolved.
+type Resolver struct {
+	Fetcher *Fetcher
+	// Concurrency is the number of peers tried at the same time.
+	Concurrency int
+	// MaxCandidates bounds the number of peers tried for one info hash,
+	// including those learned through Peer Exchange. Zero means no limit.
+	MaxCandidates int
+	// OnPeers, if set, receives every batch of peers learned through
+	// Peer Exchange.
+	OnPeers PeerHandler
+}
+
+// NewResolver returns a resolver with sensible defaults.
+func NewResolver() *Resolver {
+	return &Resolver{
+		Fetcher:       new(Fetcher),
+		Concurrency:   4,
+		MaxCandidates: 64,
+	}
+}
+
+type resolution struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	queue   []string
+	running int
+	limit   int
+	changed chan struct{}
+}
+
+// broadcast wakes every worker waiting for new candidates.
+func (res *resolution) broadcast() {
+	close(res.changed)
+	res.changed = make(chan struct{})
+}
+
+func (res *resolution) add(addr string) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if res.seen[addr] || (res.limit > 0 && len(res.seen) >= res.limit) {
+		return
+	}
+	res.seen[addr] = true
+	res.queue = append(res.queue, addr)
+	res.broadcast()
+}
+
+// next pops the next candidate. When the queue is empty it returns a
+// channel to wait on if a running fetch may still add candidates, or nil
+// if the resolution is exhausted.
+func (res *resolution) next() (addr string, ok bool, wait <-chan struct{}) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+
+	if len(res.queue) > 0 {
+		addr = res.queue[0]
+		res.queue = res.queue[1:]
+		res.running++
+		return addr, true, nil
+	}
+	if res.running > 0 {
+		return "", false, res.changed
+	}
+	return "", false, nil
+}
+
+func (res *resolution) done() {
+	res.mu.Lock()
+	res.running--
+	res.broadcast()
+	res.mu.Unlock()
+}
+
+// Resolve fetches the metadata of infoHash from peers, given as
+// "host:port" strings.
+func (r *Resolver) Resolve(ctx context.Context, infoHash []byte, peers []string) ([]byte, error) {
+	fetcher := r.Fetcher
+	if fetcher == nil {
+		fetcher = new(Fetcher)
+	}
+	workers := r.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+
+	res := &resolution{
+		seen:    make(map[string]bool),
+		limit:   r.MaxCandidates,
+		changed: make(chan struct{}),
+	}
+	for _, p := range peers {
+		res.add(p)
+	}
+
+	onPeers := func(hash []byte, added, dropped []Peer) {
+		for _, p := range added {
+			res.add(p.String())
+		}
+		if r.OnPeers != nil {
+			r.OnPeers(hash, added, dropped)
+		}
+		if fetcher.OnPeers != nil {
+			fetcher.OnPeers(hash, added, dropped)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	result := make(chan []byte, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				addr, ok, wait := res.next()
+				if !ok {
+					if wait == nil {
+						return
+					}
+					select {
+					case <-wait:
+						continue
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				b, err := fetcher.fetch(ctx, infoHash, addr, onPeers)
+				res.done()
+				if err == nil {
+					select {
+					case result <- b:
+					default:
+					}
+					cancel()
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case b := <-result:
+		return b, nil
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNoPeers
+}
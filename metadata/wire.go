@@ -0,0 +1,191 @@
+// Package metadata fetches torrent metadata from peers, and serves it to
+// them, using the extension protocol (BEP 10) and ut_metadata (BEP 9).
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+const (
+	protocol = "BitTorrent protocol"
+
+	handshakeLength = 68
+	maxMessageSize  = 2 << 20
+
+	// message id of the extension protocol, BEP 10
+	msgExtended = 20
+	// extended message id of the extension handshake
+	extHandshake = 0
+
+	// PieceSize is the size of a ut_metadata piece, BEP 9
+	PieceSize = 16384
+
+	ioTimeout = 10 * time.Second
+)
+
+var (
+	ErrBadHandshake     = errors.New("metadata: bad handshake")
+	ErrNoExtensions     = errors.New("metadata: peer does not support the extension protocol")
+	ErrMessageTooLarge  = errors.New("metadata: message too large")
+	ErrBadMessage       = errors.New("metadata: malformed message")
+	ErrInfoHashMismatch = errors.New("metadata: info hash mismatch")
+)
+
+// handshake builds the BitTorrent handshake with the extension protocol
+// and DHT bits set in the reserved bytes.
+func handshake(infoHash, peerID []byte) []byte {
+	b := make([]byte, handshakeLength)
+	b[0] = byte(len(protocol))
+	copy(b[1:20], protocol)
+	b[25] |= 0x10
+	b[27] |= 0x01
+	copy(b[28:48], infoHash)
+	copy(b[48:68], peerID)
+	return b
+}
+
+// readHandshake reads a handshake and returns the reserved bytes and the
+// info hash it carries.
+func readHandshake(conn net.Conn) (reserved, infoHash []byte, err error) {
+	b := make([]byte, handshakeLength)
+	conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, nil, err
+	}
+	if b[0] != byte(len(protocol)) || !bytes.Equal(b[1:20], []byte(protocol)) {
+		return nil, nil, ErrBadHandshake
+	}
+	return b[20:28], b[28:48], nil
+}
+
+func supportsExtensions(reserved []byte) bool {
+	return reserved[5]&0x10 != 0
+}
+
+func writeMessage(conn net.Conn, id byte, payload []byte) error {
+	b := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(b[:4], uint32(1+len(payload)))
+	b[4] = id
+	copy(b[5:], payload)
+
+	conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+	_, err := conn.Write(b)
+	return err
+}
+
+func writeExtended(conn net.Conn, extID byte, payload []byte) error {
+	b := make([]byte, 1+len(payload))
+	b[0] = extID
+	copy(b[1:], payload)
+	return writeMessage(conn, msgExtended, b)
+}
+
+// readMessage reads one length prefixed message. Keep-alives are
+// returned as an empty message with id 0xff.
+func readMessage(conn net.Conn) (id byte, payload []byte, err error) {
+	var prefix [4]byte
+	conn.SetReadDeadline(time.Now().Add(2 * ioTimeout))
+	if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return 0xff, nil, nil
+	}
+	if length > maxMessageSize {
+		return 0, nil, ErrMessageTooLarge
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// decodeDict decodes a bencoded dictionary at the start of b and returns
+// it together with the bytes trailing it, which is how ut_metadata
+// appends piece data to its messages.
+func decodeDict(b []byte) (map[string]interface{}, []byte, error) {
+	end := dictEnd(b)
+	if end < 0 || b[0] != 'd' {
+		return nil, nil, ErrBadMessage
+	}
+
+	v, err := bencode.Unmarshal(b[:end])
+	if err != nil {
+		return nil, nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, nil, ErrBadMessage
+	}
+	return dict, b[end:], nil
+}
+
+// dictEnd returns the length of the bencoded value at the start of b, or
+// -1 if it is malformed.
+func dictEnd(b []byte) int {
+	i, ok := skipValue(b, 0, 0)
+	if !ok {
+		return -1
+	}
+	return i
+}
+
+func skipValue(b []byte, i, depth int) (int, bool) {
+	if i >= len(b) || depth > 64 {
+		return 0, false
+	}
+	switch c := b[i]; {
+	case c == 'i':
+		j := bytes.IndexByte(b[i:], 'e')
+		if j < 0 {
+			return 0, false
+		}
+		return i + j + 1, true
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var ok bool
+			if i, ok = skipValue(b, i, depth+1); !ok {
+				return 0, false
+			}
+		}
+		if i >= len(b) {
+			return 0, false
+		}
+		return i + 1, true
+	case c >= '0' && c <= '9':
+		j := bytes.IndexByte(b[i:], ':')
+		if j < 0 {
+			return 0, false
+		}
+		n := 0
+		for _, d := range b[i : i+j] {
+			if d < '0' || d > '9' || n > maxMessageSize {
+				return 0, false
+			}
+			n = n*10 + int(d-'0')
+		}
+		end := i + j + 1 + n
+		if end > len(b) {
+			return 0, false
+		}
+		return end, true
+	}
+	return 0, false
+}
+
+func toInt(v interface{}) (int, bool) {
+	n, ok := v.(int64)
+	return int(n), ok
+}
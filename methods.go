@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// QueryHandler answers a query of a method registered with HandleQuery.
+// It returns the "r" dictionary of the response, the node ID is added as
+// "id". A *KRPCError such as KRPCErrProtocol is sent back as is, other
+// errors as a server error. The query and its Args must not be kept after
+// the handler returned.
+type QueryHandler func(query *KRPCQuery, remote *net.UDPAddr) (map[string]interface{}, error)
+
+// HandleQuery makes h answer the queries of method, replacing the
+// built-in handling of ping, find_node, get_peers and announce_peer. A nil
+// h removes the handler. Queries of methods without a handler are
+// answered with a 204 error.
+func (node *Node) HandleQuery(method QueryType, h QueryHandler) {
+	node.methodsMu.Lock()
+	defer node.methodsMu.Unlock()
+
+	if h == nil {
+		delete(node.methods, method)
+		return
+	}
+	if node.methods == nil {
+		node.methods = make(map[QueryType]QueryHandler)
+	}
+	node.methods[method] = h
+}
+
+func (node *Node) queryHandler(method QueryType) QueryHandler {
+	node.methodsMu.RLock()
+	defer node.methodsMu.RUnlock()
+	return node.methods[method]
+}
+
+func (node *Node) onCustomQuery(conn net.PacketConn, query *KRPCQuery, addr *net.UDPAddr, self NodeID, h QueryHandler) error {
+	fields, err := h(query, addr)
+	if err != nil {
+		var kerr *KRPCError
+		if errors.As(err, &kerr) {
+			return err
+		}
+		return KRPCErrServer
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+
+	response := KRPCResponse{
+		T:         query.T,
+		Q:         query.Q,
+		QueriedID: self,
+		Fields:    fields,
+	}
+	data, err := response.Encode()
+	if err != nil {
+		return err
+	}
+	return node.writeTo(conn, addr, data)
+}
+
+// Query sends a query of any method with the arguments args, to which the
+// node ID is added as "id", and waits for the response, see Call. The "r"
+// dictionary of the response is in its Fields.
+func (node *Node) Query(ctx context.Context, addr *net.UDPAddr, method QueryType, args map[string]interface{}) (*KRPCResponse, error) {
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	return node.Call(ctx, addr, &KRPCQuery{Q: method, Args: args})
+}
+
+// Call sends query to addr and waits for the answer until ctx is done, or
+// returns ErrTimeout after 30 seconds. The transaction id and node ID of
+// query are set if empty. An error message is returned as a *KRPCError,
+// for example KRPCErrProtocol for an announce_peer with a bad token.
+func (node *Node) Call(ctx context.Context, addr *net.UDPAddr, query *KRPCQuery) (*KRPCResponse, error) {
+	if query.T == nil {
+		query.T = node.tokenManager.GenToken()
+	}
+	if query.NID == (NodeID{}) {
+		query.NID = node.ID
+	}
+
+	reply := make(chan answer, 1)
+	tx := &transaction{reply: reply}
+	if err := node.send(addr, query, tx); err != nil {
+		return nil, err
+	}
+	timeout := time.NewTimer(transactionTimeout)
+	defer timeout.Stop()
+
+	var err error
+	select {
+	case a := <-reply:
+		return a.r, a.err
+	case <-timeout.C:
+		err = ErrTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-node.closed:
+		err = ErrNodeClosed
+	}
+	node.transactions.remove(query.T, addr, tx)
+	return nil, err
+}
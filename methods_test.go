@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestCustomMethod(t *testing.T) {
+	server := newTestNode(t)
+	client := newTestNode(t)
+	server.HandleQuery("sample_infohashes", func(query *KRPCQuery, remote *net.UDPAddr) (map[string]interface{}, error) {
+		if !bytes.Equal(query.Args["target"].([]byte), bytes.Repeat([]byte{1}, 20)) {
+			return nil, KRPCErrProtocol
+		}
+		return map[string]interface{}{"samples": bytes.Repeat([]byte{2}, 40)}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r, err := client.Query(ctx, server.LocalAddr().(*net.UDPAddr), "sample_infohashes", map[string]interface{}{
+		"target": bytes.Repeat([]byte{1}, 20),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.QueriedID != server.ID || !bytes.Equal(r.Fields["samples"].([]byte), bytes.Repeat([]byte{2}, 40)) {
+		t.Errorf("unexpected response %+v", r)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	node := newTestNode(t)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	query, err := (&KRPCQuery{T: []byte("aa"), Q: "vote", NID: GenerateNodeID(), Args: map[string]interface{}{}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(query, node.LocalAddr())
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no error reply:", err)
+		}
+		if messageType(buf[:n]) != "e" {
+			continue
+		}
+		e, _ := bencode.Unmarshal(buf[:n])
+		msg := e.(map[string]interface{})
+		if code := msg["e"].([]interface{})[0].(int64); code != 204 || string(msg["t"].([]byte)) != "aa" {
+			t.Errorf("got %v, want a 204 error", msg)
+		}
+		return
+	}
+}
+
+func TestDroppedTransactionsAnswered(t *testing.T) {
+	ts := newTransactions()
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+
+	reply := make(chan answer, 1)
+	tx := &transaction{q: PingType, reply: reply}
+	ts.add([]byte("aa"), addr, tx)
+	tx.deadline = time.Now().Add(-time.Second)
+	if ts.take([]byte("aa"), addr) != nil {
+		t.Fatal("expired transaction taken")
+	}
+	if a := <-reply; a.err != ErrTimeout {
+		t.Errorf("got %v for an expired transaction, want ErrTimeout", a.err)
+	}
+
+	tx = &transaction{q: PingType, reply: reply}
+	ts.add([]byte("bb"), addr, tx)
+	tx.deadline = time.Now().Add(-time.Second)
+	ts.swept = time.Time{}
+	ts.add([]byte("cc"), addr, &transaction{q: PingType})
+	select {
+	case a := <-reply:
+		if a.err != ErrTimeout {
+			t.Errorf("got %v for a swept transaction, want ErrTimeout", a.err)
+		}
+	default:
+		t.Error("swept transaction not answered")
+	}
+}
@@ -2,15 +2,19 @@ package dht
 
 import (
 	"bytes"
-	// "encoding/hex"
+	"context"
+	"encoding/hex"
 	"errors"
 	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bttown/dht/utp"
 	"github.com/bttown/routing-table"
 )
 
@@ -21,11 +25,29 @@ var bootstrapNodes = []string{
 	"dht.libtorrent.org:25401",
 }
 
-var randSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+var (
+	ErrNodeClosed     = errors.New("node closed")
+	ErrNodeRunning    = errors.New("node already running")
+	ErrNodeNotRunning = errors.New("node not running")
+	// ErrServeOption is returned by Serve for options that only take
+	// effect in NewNode, such as OptionNodeID and OptionIdentities.
+	ErrServeOption = errors.New("option only takes effect in NewNode")
+)
+
+// bootstrapGrace is how long saved and imported contacts get to answer
+// before the public routers are used.
+const bootstrapGrace = 5 * time.Second
+
+var (
+	randSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randMu     sync.Mutex
+)
 
 func generateBytes() []byte {
 	buf := make([]byte, NodeIDBytes)
+	randMu.Lock()
 	randSource.Read(buf)
+	randMu.Unlock()
 	return buf
 }
 
@@ -51,34 +73,111 @@ func GetNeighborNID(id NodeID, hash []byte) NodeID {
 }
 
 type Node struct {
+	answered uint32 // set once any remote answered one of our queries
+
 	NodeInfo
 	localUDPAddr net.UDPAddr
-	udpConn      *net.UDPConn
+	conn         net.PacketConn
+	ownConn      bool
 	NetWork      string
 	tokenManager *TokenManager
 	table        *table.Table
-	PeerHandler  func(ip string, port int, infoHash, peerID string)
+	limiter      *rateLimiter
+	workers      *workerPool
+	ipFilter     *IPFilter
+	scores       *scoreboard
+	transactions *transactions
+	writeTokens  *writeTokens
+	guard        *amplificationGuard
+	crawler      *crawler
+	identities   *identities
+	identityIDs  []NodeID
+	events       EventHandler
+	eventQueue   *eventQueue
+	interceptors []Interceptor
+	logger       Logger
+	methods      map[QueryType]QueryHandler
+	methodsMu    sync.RWMutex
+	// PeerHandler is called for every announce_peer, see PeerHandlerFunc.
+	// Prefer OptionEventHandler, which receives all the traffic.
+	PeerHandler func(ip string, port int, infoHash, peerID string)
+
+	// configErr is an invalid option, returned by Start
+	configErr error
 
-	findNodeChan chan *NodeInfo
 	closed       chan struct{}
 	dumpFileName string
+	dumpInterval time.Duration
+	fixedID      bool
 	running      bool
+	stopped      bool
+	mu           sync.Mutex
+	background   sync.WaitGroup
+	handlers     sync.WaitGroup
+
+	routers           []string
+	bootstrapFiles    []string
+	bootstrapContacts []*NodeInfo
+
+	enableUTP bool
+	utpSocket *utp.Socket
+
+	batchSize   int
+	readBuffer  int
+	writeBuffer int
+
+	// conns are the sockets read by the node, conn is the first one and
+	// sends the queries
+	conns     []net.PacketConn
+	sockets   int
+	reusePort bool
 }
 
 func NewNode(opts ...NodeOption) *Node {
 	node := &Node{
 		NodeInfo:     NodeInfo{},
 		NetWork:      "udp",
+		routers:      bootstrapNodes,
 		dumpFileName: "dump.ktb",
+		dumpInterval: defaultDumpInterval,
 
 		tokenManager: defaultTokenManager,
+		limiter:      newRateLimiter(DefaultRateLimits),
+		ipFilter:     NewIPFilter(true),
+		scores:       newScoreboard(DefaultBanPolicy),
+		transactions: newTransactions(),
+		writeTokens:  newWriteTokens(),
+		guard:        newAmplificationGuard(DefaultAmplificationLimits),
+		crawler:      newCrawler(DefaultCrawlerConfig),
+		identities:   newIdentities(),
+		eventQueue:   newEventQueue(EventQueue{}),
+		logger:       nopLogger{},
+
+		closed: make(chan struct{}),
+	}
 
-		findNodeChan: make(chan *NodeInfo, 300),
-		closed:       make(chan struct{}),
+	node.ID = GenerateNodeID()
+
+	for _, option := range opts {
+		option(node)
 	}
 
-	b := GenerateNodeID()
-	copy(node.ID[:], b[:])
+	if node.workers == nil {
+		node.workers = newWorkerPool(WorkerPool{})
+	}
+	node.initTable()
+	for _, id := range node.identityIDs {
+		// the ID is only final once all the options are applied
+		if err := node.AddIdentity(id); err != nil && node.configErr == nil {
+			node.configErr = err
+		}
+	}
+
+	return node
+}
+
+// initTable creates the routing table owned by the node ID.
+func (node *Node) initTable() {
 	t := table.NewTable(table.Hash(node.ID), node)
 	tid := t.OwnerID()
 	if !bytes.Equal(tid[:], node.ID[:]) {
@@ -86,32 +185,44 @@ func NewNode(opts ...NodeOption) *Node {
 	}
 
 	node.table = t
+}
 
-	for _, option := range opts {
-		option(node)
+// needRouters reports whether the public bootstrap routers have to be
+// queried: when we have no contacts of our own, or none of them answered
+// within bootstrapGrace.
+func (node *Node) needRouters(start time.Time) bool {
+	if len(node.bootstrapContacts) == 0 {
+		return true
 	}
-
-	return node
+	return atomic.LoadUint32(&node.answered) == 0 && time.Since(start) > bootstrapGrace
 }
 
 func (node *Node) joinDHTNetwork() error {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
+	// ping the contacts saved before the restart or imported from other
+	// clients first, they answer much faster than the routers fill the table
+	for _, info := range node.bootstrapContacts {
+		node.Ping(&info.UDPAddr)
+	}
+	start := time.Now()
+
 	for {
 		id := GenerateNodeID()
 		select {
 		case <-node.closed:
 			return nil
-		case info := <-node.findNodeChan:
-			node.FindNode(&info.UDPAddr, id)
 		case <-ticker.C:
-			for _, bootStrapNode := range bootstrapNodes {
-				nodeAddr, err := net.ResolveUDPAddr(node.NetWork, bootStrapNode)
-				if err != nil {
-					continue
+			if node.needRouters(start) {
+				for _, bootStrapNode := range node.routers {
+					nodeAddr, err := net.ResolveUDPAddr(node.NetWork, bootStrapNode)
+					if err != nil {
+						continue
+					}
+					node.scores.exemptIP(nodeAddr.IP)
+					node.FindNode(nodeAddr, id)
 				}
-				node.FindNode(nodeAddr, id)
 			}
 
 			neighbors := node.table.Closest(table.Hash(id), 8)
@@ -120,22 +231,25 @@ func (node *Node) joinDHTNetwork() error {
 				// log.Println("send find node to neighbor node", neighbor)
 				node.FindNode(&neighbor.UDPAddr, id)
 			}
+			node.refreshIdentities()
 		}
 	}
 }
 
-func (node *Node) handleKRPCMsg(remote *net.UDPAddr, b []byte) error {
+func (node *Node) handleKRPCMsg(conn net.PacketConn, remote *net.UDPAddr, b []byte) error {
 	defer func() {
 		if r := recover(); r != nil {
 			var buf = make([]byte, 1024)
 			n := runtime.Stack(buf, false)
-			log.Println("recover", r, "/n", string(buf[:n]), "data", b)
+			node.logger.Error("recover", "remote", remote, "panic", r, "stack", string(buf[:n]), "data", hex.EncodeToString(b))
+			node.penalize(remote, OffenseMalformed)
 		}
 	}()
 
 	msg, err := NewKRPCMessage(b)
 	if err != nil {
-		log.Println("NewKRPCMessage fatal", err)
+		node.logger.Debug("malformed message", "remote", remote, "err", err)
+		node.penalize(remote, OffenseMalformed)
 		return err
 	}
 
@@ -144,53 +258,184 @@ func (node *Node) handleKRPCMsg(remote *net.UDPAddr, b []byte) error {
 		query := new(KRPCQuery)
 		query.Loads(msg.data)
 
-		contactID := table.Hash(query.NID)
-		node.table.Update(&table.Contact{
-			UDPAddr: *remote,
-			NID:     contactID,
-		})
-
-		switch query.Q {
-		case PingType:
-			node.onPingQuery(query, remote)
-		case FindNodeType:
-			node.onFindNodeQuery(query, remote)
-		case GetPeersType:
-			node.onGetPeersQuery(query, remote)
-		case AnnouncePeerType:
-			node.onAnnouncePeer(query, remote)
-		default:
+		if !node.limiter.allowIncoming(remote.IP) {
+			node.penalize(remote, OffenseFlood)
 			return nil
 		}
 
+		err := node.intercept(&Message{Query: query}, remote, func(m *Message, remote *net.UDPAddr) error {
+			return node.handleQuery(conn, m.Query, remote)
+		})
+		var kerr *KRPCError
+		if errors.As(err, &kerr) {
+			data, err := encodeKRPCError(query.T, kerr)
+			if err != nil {
+				return err
+			}
+			return node.writeTo(conn, remote, data)
+		}
+		return err
+
 	} else if msg.IsResponse() {
 		r := new(KRPCResponse)
 		r.Loads(msg.data)
+		tx := node.transactions.take(r.T, remote)
+		if tx == nil {
+			node.penalize(remote, OffenseUnsolicited)
+			return nil
+		}
+		if node.boundElsewhere(r.QueriedID, remote) {
+			node.penalizeResponder(remote, OffenseIDMismatch)
+			tx.answer(answer{err: ErrIDMismatch})
+			return nil
+		}
 
-		contactID := table.Hash(r.QueriedID)
-		node.table.Update(&table.Contact{
-			UDPAddr: *remote,
-			NID:     contactID,
+		r.Q = tx.q
+		return node.intercept(&Message{Response: r}, remote, func(m *Message, remote *net.UDPAddr) error {
+			node.handleResponse(m.Response, tx, remote)
+			return nil
 		})
 
-		if len(r.Nodes) > 0 {
-			for _, nodeInfo := range r.Nodes {
-				node.findNodeChan <- nodeInfo
-			}
-		}
 	} else if msg.IsError() {
 		err := LoadKRPCErrorMsg(msg.data)
-		log.Printf("krpc error msg from %v, %v", remote, err)
+		tx := node.transactions.take([]byte(msg.T), remote)
+		if tx == nil {
+			node.penalize(remote, OffenseUnsolicited)
+			return nil
+		}
+		// only the remote we queried knows the transaction id
+		node.guard.verify(remote.IP)
+
+		node.logger.Debug("error reply", "remote", remote, "method", tx.q, "tx", hex.EncodeToString([]byte(msg.T)), "err", err)
+		tx.answer(answer{err: err})
+		if node.observed() {
+			e := ErrorEvent{Node: newNodeInfo(NodeID{}, remote), Method: tx.q, Err: err}
+			node.emit(func(h EventHandler) { h.OnError(e) })
+		}
 	}
 
 	return nil
 }
 
+// handleQuery answers a query that passed the rate limits and the
+// interceptors.
+func (node *Node) handleQuery(conn net.PacketConn, query *KRPCQuery, remote *net.UDPAddr) error {
+	self := node.replyID(query, remote)
+
+	// the source of a query may be spoofed, it is only stored once
+	// it answered a ping
+	if node.boundElsewhere(query.NID, remote) {
+		node.penalize(remote, OffenseIDMismatch)
+	} else if node.guard.isVerified(remote.IP) {
+		contactID := table.Hash(query.NID)
+		node.tableFor(self).Update(&table.Contact{
+			UDPAddr: *remote,
+			NID:     contactID,
+		})
+	} else if node.guard.probe(remote.IP) {
+		node.Ping(remote)
+	}
+
+	if h := node.queryHandler(query.Q); h != nil {
+		return node.onCustomQuery(conn, query, remote, self, h)
+	}
+
+	switch query.Q {
+	case PingType:
+		return node.onPingQuery(conn, query, remote, self)
+	case FindNodeType:
+		return node.onFindNodeQuery(conn, query, remote, self)
+	case GetPeersType:
+		return node.onGetPeersQuery(conn, query, remote, self)
+	case AnnouncePeerType:
+		return node.onAnnouncePeer(conn, query, remote, self)
+	default:
+		return KRPCErrMethodUnknown
+	}
+}
+
+// handleResponse processes the response r to our query tx once it passed
+// the interceptors.
+func (node *Node) handleResponse(r *KRPCResponse, tx *transaction, remote *net.UDPAddr) {
+	atomic.StoreUint32(&node.answered, 1)
+	node.guard.verify(remote.IP)
+
+	contactID := table.Hash(r.QueriedID)
+	node.tableFor(tx.id).Update(&table.Contact{
+		UDPAddr: *remote,
+		NID:     contactID,
+	})
+
+	if node.observed() {
+		e := ResponseEvent{Node: newNodeInfo(r.QueriedID, remote), Method: tx.q, Response: cloneResponse(r)}
+		node.emit(func(h EventHandler) { h.OnResponse(e) })
+	}
+	if tx.q == FindNodeType {
+		node.crawler.onAnswer(r.QueriedID, tx.crawl)
+	}
+	if tx.reply != nil {
+		tx.answer(answer{r: cloneResponse(r)})
+	}
+
+	bogus := false
+	max := node.guard.limits.MaxContactsPerResponse
+	queued := 0
+	for _, nodeInfo := range r.Nodes {
+		if node.blocked(&nodeInfo.UDPAddr) {
+			bogus = true
+			continue
+		}
+		if node.scores.banned(nodeInfo.IP) {
+			continue
+		}
+		if node.observed() {
+			e := NodeDiscoveredEvent{Node: *nodeInfo, From: newNodeInfo(r.QueriedID, remote)}
+			node.emit(func(h EventHandler) { h.OnNodeDiscovered(e) })
+		}
+		if max > 0 && queued >= max {
+			break
+		}
+		queued++
+		node.crawler.offer(nodeInfo)
+	}
+	// lists pointing at addresses nobody should query are used to
+	// aim DHT traffic at victims
+	if bogus {
+		node.penalizeResponder(remote, OffenseBogusNodes)
+	}
+}
+
 func (node *Node) writeToUDP(addr *net.UDPAddr, data []byte) error {
-	node.udpConn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	n, err := node.udpConn.WriteToUDP(data, addr)
+	return node.writeTo(node.conn, addr, data)
+}
+
+// writeTo sends data to addr through conn, one of the node's sockets.
+func (node *Node) writeTo(conn net.PacketConn, addr *net.UDPAddr, data []byte) error {
+	select {
+	case <-node.closed:
+		return ErrNodeClosed
+	default:
+	}
+	if conn == nil {
+		return ErrNodeNotRunning
+	}
+	if node.blocked(addr) {
+		return ErrIPFiltered
+	}
+	if node.scores.banned(addr.IP) {
+		return ErrBanned
+	}
+	if !node.guard.allowSend(addr.IP, len(data)) {
+		return ErrAmplification
+	}
+	if !node.limiter.allowOutgoing() {
+		return ErrRateLimited
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.WriteTo(data, addr)
 	if err != nil {
-		log.Println("writeToUdp", err)
+		node.logger.Debug("write", "remote", addr, "err", err)
 		return err
 	}
 
@@ -200,74 +445,307 @@ func (node *Node) writeToUDP(addr *net.UDPAddr, data []byte) error {
 	return err
 }
 
-func (node *Node) receiveUDP(conn *net.UDPConn) error {
-	var buf = make([]byte, 8192)
+// sendQuery encodes query and sends it to addr, within the budget of its
+// query type.
+func (node *Node) sendQuery(addr *net.UDPAddr, query *KRPCQuery) error {
+	return node.send(addr, query, &transaction{})
+}
+
+// send sends query to addr and remembers it as tx until it is answered.
+func (node *Node) send(addr *net.UDPAddr, query *KRPCQuery, tx *transaction) error {
+	if !node.limiter.allowQuery(query.Q) {
+		return ErrRateLimited
+	}
+
+	data, err := query.Encode()
+	if err != nil {
+		return err
+	}
+	tx.q, tx.id = query.Q, query.NID
+	node.transactions.add(query.T, addr, tx)
+	node.present(addr, query.NID)
+	if err := node.writeToUDP(addr, data); err != nil {
+		node.transactions.remove(query.T, addr, tx)
+		return err
+	}
+	return nil
+}
+
+// udpAddr converts the source address returned by the packet conn.
+// Transports other than UDP sockets have to use addresses whose String
+// form is a valid "ip:port".
+func udpAddr(addr net.Addr) (*net.UDPAddr, error) {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+func (node *Node) receiveUDP(conn net.PacketConn) error {
 	for {
-		n, addr, err := conn.ReadFromUDP(buf)
+		buf := packetPool.Get().(*[]byte)
+		n, from, err := conn.ReadFrom(*buf)
 		if err != nil {
+			packetPool.Put(buf)
 			return err
 		}
+		addr, err := udpAddr(from)
+		if err != nil || node.blocked(addr) || node.scores.banned(addr.IP) {
+			packetPool.Put(buf)
+			continue
+		}
 
-		newBuf := make([]byte, n)
-		copy(newBuf, buf)
-		if len(newBuf) != n {
-			panic("copy buffer fatal")
+		// uTP packets share the port, tell them apart by the first byte
+		if node.utpSocket != nil && conn == node.conn && utp.IsPacket((*buf)[:n]) {
+			node.utpSocket.HandlePacket((*buf)[:n], addr)
+			packetPool.Put(buf)
+			continue
 		}
-		go node.handleKRPCMsg(addr, newBuf)
+
+		node.guard.received(addr.IP, n)
+		node.workers.push(packet{buf: buf, n: n, addr: addr, conn: conn}, node.closed)
 	}
 }
 
 func (node *Node) serveUDP() error {
 
-	conn, err := net.ListenUDP(node.NetWork, &node.localUDPAddr)
-	if err != nil {
-		return err
+	conns := []net.PacketConn{node.conn}
+	if node.conn == nil {
+		var err error
+		if conns, err = node.listen(); err != nil {
+			return err
+		}
+		node.ownConn = true
 	}
 
-	go func() {
-		err := node.receiveUDP(conn)
-		log.Println("quit receiveUDP with", err)
-	}()
-	node.udpConn = conn
+	node.conn = conns[0]
+	node.conns = conns
+	if node.enableUTP {
+		node.utpSocket = utp.NewSharedSocket(node.conn.LocalAddr(), node.conn.WriteTo)
+	}
+
+	node.startWorkers()
+	node.startEventWorkers()
+	for _, conn := range conns {
+		conn := conn
+		node.goBackground(func() {
+			err := node.receiveUDP(conn)
+			select {
+			case <-node.closed:
+			default:
+				node.logger.Error("quit receiving", "local", conn.LocalAddr(), "err", err)
+			}
+		})
+	}
 	return nil
 }
 
+// UTP returns the uTP socket sharing the node's UDP port, or nil if the
+// node was not created with OptionUTP or is not serving yet.
+func (node *Node) UTP() *utp.Socket {
+	return node.utpSocket
+}
+
+// WaitSignal blocks until the process receives an interrupt, then shuts
+// the node down.
 func (node *Node) WaitSignal() error {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	<-c
+	defer signal.Stop(c)
 
-	log.Println("stop node...")
+	select {
+	case <-c:
+	case <-node.closed:
+		return nil
+	}
 
-	close(node.findNodeChan)
-	close(node.closed)
+	node.logger.Info("stop node")
+	return node.Shutdown(context.Background())
+}
 
-	node.table.Stop()
+// Start starts the node and returns once it is listening. The node keeps
+// running in the background until Shutdown is called or ctx is done. It
+// returns ErrIdentityExists if the node ID saved in the dump file is one
+// of the node's identities.
+func (node *Node) Start(ctx context.Context) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
 
-	node.running = false
-	return node.udpConn.Close()
-}
+	if node.stopped {
+		return ErrNodeClosed
+	}
+	if node.running {
+		return ErrNodeRunning
+	}
+	if node.configErr != nil {
+		return node.configErr
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-func (node *Node) Serve(opts ...NodeOption) error {
-	for _, opt := range opts {
-		opt(node)
+	// the contacts are only kept once the node runs, so that Start can be
+	// retried
+	saved, err := node.loadRoutingTable()
+	if err == ErrIdentityExists {
+		return err
+	}
+	if err != nil {
+		node.logger.Warn("load routing table", "file", node.dumpFileName, "err", err)
+	}
+	contacts := saved
+	for _, filename := range node.bootstrapFiles {
+		nodes, err := LoadNodeStateFile(filename)
+		if err != nil {
+			node.logger.Warn("import DHT state", "file", filename, "err", err)
+			continue
+		}
+		contacts = append(contacts, nodes...)
 	}
 
+	if err := node.serveUDP(); err != nil {
+		node.logger.Error("start UDP listener", "err", err)
+		return err
+	}
+	node.bootstrapContacts = append(node.bootstrapContacts, contacts...)
+	node.logger.Info("start node", "id", hex.EncodeToString(node.ID[:]), "local", node.conn.LocalAddr(), "wan", &node.UDPAddr)
+
 	node.running = true
+	node.goBackground(func() { node.joinDHTNetwork() })
+	node.goBackground(node.crawl)
+	if node.dumpFileName != "" {
+		node.goBackground(node.dumpLoop)
+	}
 
-	log.Printf("start node %s...\n", node.NodeInfo.String())
-	log.Printf("Lo address => %s:%d", node.localUDPAddr.IP.String(), node.localUDPAddr.Port)
-	log.Printf("WAN address => %s:%d", node.UDPAddr.IP.String(), node.UDPAddr.Port)
-	if err := node.serveUDP(); err != nil {
-		log.Println("start UDP listener fatal", err)
+	// a context that can never be done, such as context.Background, does
+	// not need a watcher
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				node.Shutdown(context.Background())
+			case <-node.closed:
+			}
+		}()
+	}
+
+	node.logger.Info("join the DHT network", "routers", len(node.routers), "contacts", len(node.bootstrapContacts))
+	return nil
+}
+
+func (node *Node) goBackground(f func()) {
+	node.background.Add(1)
+	go func() {
+		defer node.background.Done()
+		f()
+	}()
+}
+
+// Shutdown stops the node: the crawl loop and the UDP reader quit, the
+// socket is closed and, once in-flight handlers returned and the queued
+// events were delivered, the routing table is saved. If ctx is done
+// before, Shutdown gives up waiting and returns ctx.Err(). Calling it
+// again is a no-op.
+func (node *Node) Shutdown(ctx context.Context) error {
+	node.mu.Lock()
+	if node.stopped {
+		node.mu.Unlock()
+		return nil
+	}
+	node.stopped = true
+	wasRunning := node.running
+	node.running = false
+	close(node.closed)
+	node.mu.Unlock()
+
+	if !wasRunning {
+		node.table.Stop()
+		node.identities.stop()
+		node.eventQueue.close()
+		return nil
+	}
+
+	// a packet conn passed with OptionPacketConn belongs to the caller,
+	// only unblock the reader
+	var err error
+	if node.ownConn {
+		for _, conn := range node.conns {
+			if cerr := conn.Close(); err == nil {
+				err = cerr
+			}
+		}
+	} else {
+		node.conn.SetReadDeadline(time.Now())
+	}
+	if node.utpSocket != nil {
+		node.utpSocket.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		node.background.Wait()
+		// the readers are gone, the caller's conn can be read again
+		if !node.ownConn {
+			node.conn.SetReadDeadline(time.Time{})
+		}
+		node.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		node.eventQueue.close()
+		return ctx.Err()
+	}
+
+	// no handler queues events anymore
+	if err := node.eventQueue.flush(ctx); err != nil {
+		node.eventQueue.close()
 		return err
 	}
+	node.eventQueue.close()
+
+	if err := node.SaveRoutingTable(); err != nil {
+		node.logger.Warn("save routing table", "file", node.dumpFileName, "err", err)
+	}
+	node.table.Stop()
+	node.identities.stop()
+
+	return err
+}
 
-	log.Println("start UDP listener...")
+// LocalAddr returns the address the node is listening on, or nil if it
+// is not running.
+func (node *Node) LocalAddr() net.Addr {
+	if node.conn == nil {
+		return nil
+	}
+	return node.conn.LocalAddr()
+}
 
-	go node.joinDHTNetwork()
+// Done returns a channel closed once the node is shut down.
+func (node *Node) Done() <-chan struct{} {
+	return node.closed
+}
 
-	log.Println("start to join the DHT network...")
+// Serve starts the node and blocks until the process is interrupted. Use
+// Start and Shutdown to embed the node in a program with its own signal
+// handling. opts are applied before starting; the ones that set the node
+// IDs, which the routing tables are built for in NewNode, are refused with
+// ErrServeOption and leave the node as it was.
+func (node *Node) Serve(opts ...NodeOption) error {
+	id, fixedID, identityIDs := node.ID, node.fixedID, len(node.identityIDs)
+	for _, opt := range opts {
+		opt(node)
+	}
+	if node.ID != id || len(node.identityIDs) != identityIDs {
+		node.ID, node.fixedID, node.identityIDs = id, fixedID, node.identityIDs[:identityIDs]
+		return ErrServeOption
+	}
 
+	if err := node.Start(context.Background()); err != nil {
+		return err
+	}
 	return node.WaitSignal()
 }
@@ -0,0 +1,167 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/IncSW/go-bencode"
+)
+
+// ErrUnknownStateFormat is returned when a DHT state file is in none of
+// the supported formats.
+var ErrUnknownStateFormat = errors.New("unknown DHT state format")
+
+// ParseNodeState parses the DHT state kept by other clients and returns
+// our previous node ID, if the file has one, and the contacts it holds.
+// Supported formats are:
+//
+//   - libtorrent session state, with a "dht state" dictionary holding
+//     "node-id", "nodes" and "nodes6"
+//   - Transmission's dht.dat with "id", "nodes" and "nodes6"
+//   - our own routing table dump, see OptionDumpFile
+//
+// libtorrent and Transmission only save contact addresses, the IDs of
+// contacts parsed from them are zero.
+func ParseNodeState(b []byte) (NodeID, []*NodeInfo, error) {
+	if strings.HasPrefix(string(b), dumpMagic) {
+		id, _, nodes, err := decodeDump(b)
+		return id, nodes, err
+	}
+
+	var id NodeID
+	v, err := bencode.Unmarshal(b)
+	if err != nil {
+		return id, nil, err
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return id, nil, ErrUnknownStateFormat
+	}
+
+	if state, ok := dict["dht state"].(map[string]interface{}); ok {
+		dict = state
+	}
+
+	var nodes []*NodeInfo
+	switch {
+	case dict["node-id"] != nil:
+		id = parseLibtorrentNodeID(dict["node-id"])
+	case dict["id"] != nil:
+		if b, ok := dict["id"].([]byte); ok && len(b) == NodeIDBytes {
+			copy(id[:], b)
+		}
+	case dict["nodes"] == nil && dict["nodes6"] == nil:
+		return id, nil, ErrUnknownStateFormat
+	}
+
+	nodes = append(nodes, parseCompactEndpoints(dict["nodes"], net.IPv4len)...)
+	nodes = append(nodes, parseCompactEndpoints(dict["nodes6"], net.IPv6len)...)
+	return id, nodes, nil
+}
+
+// parseLibtorrentNodeID handles both the plain 20 byte string of older
+// libtorrent versions and the list of id+address strings saved since 1.2,
+// in which case the first ID is used.
+func parseLibtorrentNodeID(v interface{}) NodeID {
+	var id NodeID
+	switch x := v.(type) {
+	case []byte:
+		if len(x) >= NodeIDBytes {
+			copy(id[:], x)
+		}
+	case []interface{}:
+		for _, e := range x {
+			if b, ok := e.([]byte); ok && len(b) >= NodeIDBytes {
+				copy(id[:], b)
+				break
+			}
+		}
+	}
+	return id
+}
+
+// parseCompactEndpoints parses ip+port endpoints with the port in network
+// byte order, given either as one concatenated string or, as libtorrent
+// does, as a list of strings.
+func parseCompactEndpoints(v interface{}, ipLen int) []*NodeInfo {
+	var chunks [][]byte
+	size := ipLen + 2
+
+	switch x := v.(type) {
+	case []byte:
+		for i := 0; i+size <= len(x); i += size {
+			chunks = append(chunks, x[i:i+size])
+		}
+	case []interface{}:
+		for _, e := range x {
+			if b, ok := e.([]byte); ok {
+				chunks = append(chunks, b)
+			}
+		}
+	}
+
+	nodes := make([]*NodeInfo, 0, len(chunks))
+	for _, b := range chunks {
+		if len(b) != net.IPv4len+2 && len(b) != net.IPv6len+2 {
+			continue
+		}
+		ip := make(net.IP, len(b)-2)
+		copy(ip, b)
+		port := int(binary.BigEndian.Uint16(b[len(b)-2:]))
+		if port == 0 {
+			continue
+		}
+		nodes = append(nodes, &NodeInfo{UDPAddr: net.UDPAddr{IP: ip, Port: port}})
+	}
+	return nodes
+}
+
+// LoadNodeStateFile reads a DHT state file, see ParseNodeState.
+func LoadNodeStateFile(filename string) ([]*NodeInfo, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, nodes, err := ParseNodeState(b)
+	return nodes, err
+}
+
+// EncodeTransmissionState encodes id and nodes in the format of
+// Transmission's dht.dat.
+func EncodeTransmissionState(id NodeID, nodes []*NodeInfo) ([]byte, error) {
+	var nodes4, nodes6 []byte
+	var port [2]byte
+
+	for _, info := range nodes {
+		binary.BigEndian.PutUint16(port[:], uint16(info.Port))
+		if ip := info.IP.To4(); ip != nil {
+			nodes4 = append(nodes4, ip...)
+			nodes4 = append(nodes4, port[:]...)
+		} else if ip := info.IP.To16(); ip != nil {
+			nodes6 = append(nodes6, ip...)
+			nodes6 = append(nodes6, port[:]...)
+		}
+	}
+
+	state := map[string]interface{}{
+		"id":    id[:],
+		"nodes": nodes4,
+	}
+	if len(nodes6) > 0 {
+		state["nodes6"] = nodes6
+	}
+	return bencode.Marshal(state)
+}
+
+// ExportNodeState writes the node ID and routing table contacts to
+// filename in the format of Transmission's dht.dat.
+func (node *Node) ExportNodeState(filename string) error {
+	b, err := EncodeTransmissionState(node.ID, node.Contacts())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, b)
+}
@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/IncSW/go-bencode"
+)
+
+func TestTransmissionStateRoundTrip(t *testing.T) {
+	id := GenerateNodeID()
+	nodes := []*NodeInfo{
+		{UDPAddr: net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}},
+		{UDPAddr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51413}},
+	}
+
+	b, err := EncodeTransmissionState(id, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotID, got, err := ParseNodeState(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id {
+		t.Error("node ID was not parsed")
+	}
+	if len(got) != 2 || !got[0].IP.Equal(nodes[0].IP) || got[1].Port != 51413 {
+		t.Errorf("unexpected contacts %v", got)
+	}
+}
+
+func TestParseLibtorrentState(t *testing.T) {
+	id := GenerateNodeID()
+	b, _ := bencode.Marshal(map[string]interface{}{
+		"dht state": map[string]interface{}{
+			"node-id": []interface{}{append(id[:], 10, 0, 0, 1)},
+			"nodes": []interface{}{
+				[]byte{10, 0, 0, 2, 0x1a, 0xe1},
+				[]byte{10, 0, 0, 3, 0x1a, 0xe2},
+			},
+		},
+	})
+
+	gotID, nodes, err := ParseNodeState(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotID != id {
+		t.Error("node ID was not parsed")
+	}
+	if len(nodes) != 2 || nodes[1].String() == "" || nodes[1].Port != 6882 {
+		t.Errorf("unexpected contacts %v", nodes)
+	}
+
+	if _, _, err := ParseNodeState([]byte("d3:fooi1ee")); err != ErrUnknownStateFormat {
+		t.Errorf("expected ErrUnknownStateFormat, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package dht
 import (
 	"encoding/hex"
 	"net"
+	"time"
 )
 
 const (
@@ -13,6 +14,7 @@ type NodeOption func(node *Node)
 
 func OptionNodeID(nid string) NodeOption {
 	return func(node *Node) {
+		node.fixedID = true
 		if nid == RANDOM {
 			node.ID = GenerateNodeID()
 		} else {
@@ -50,3 +52,196 @@ func OptionAddress(addr string) NodeOption {
 		node.localUDPAddr = *addr
 	}
 }
+
+// OptionUTP runs a uTP socket on the node's UDP port, see Node.UTP.
+func OptionUTP() NodeOption {
+	return func(node *Node) {
+		node.enableUTP = true
+	}
+}
+
+// OptionDumpFile sets the file the routing table is saved to and restored
+// from, "dump.ktb" by default. An empty name disables persistence.
+func OptionDumpFile(filename string) NodeOption {
+	return func(node *Node) {
+		node.dumpFileName = filename
+	}
+}
+
+// OptionDumpInterval sets how often the routing table is saved while the
+// node is running.
+func OptionDumpInterval(interval time.Duration) NodeOption {
+	return func(node *Node) {
+		node.dumpInterval = interval
+	}
+}
+
+// OptionBootstrapFiles imports contacts from the DHT state files of other
+// clients, see ParseNodeState. They are pinged when the node starts and the
+// public routers are only used if none of them answers.
+func OptionBootstrapFiles(filenames ...string) NodeOption {
+	return func(node *Node) {
+		node.bootstrapFiles = append(node.bootstrapFiles, filenames...)
+	}
+}
+
+// OptionBootstrapContacts adds contacts to ping when the node starts,
+// like OptionBootstrapFiles.
+func OptionBootstrapContacts(nodes []*NodeInfo) NodeOption {
+	return func(node *Node) {
+		node.bootstrapContacts = append(node.bootstrapContacts, nodes...)
+	}
+}
+
+// OptionPacketConn makes the node read and write KRPC messages through pc
+// instead of listening on its own UDP socket. The caller keeps ownership:
+// pc is not closed on Shutdown and can be read again once Shutdown
+// returned. It can be a shared socket, a wrapper for traffic accounting or
+// an in-memory network for tests.
+func OptionPacketConn(pc net.PacketConn) NodeOption {
+	return func(node *Node) {
+		node.conn = pc
+	}
+}
+
+// OptionRouters replaces the public bootstrap routers, such as
+// router.bittorrent.com, with addrs.
+func OptionRouters(addrs ...string) NodeOption {
+	return func(node *Node) {
+		node.routers = addrs
+	}
+}
+
+// OptionRateLimits replaces DefaultRateLimits, see RateLimits.
+func OptionRateLimits(limits RateLimits) NodeOption {
+	return func(node *Node) {
+		node.limiter = newRateLimiter(limits)
+	}
+}
+
+// OptionWorkerPool sets the number of workers handling received packets
+// and the size and drop policy of their queue, see WorkerPool.
+func OptionWorkerPool(config WorkerPool) NodeOption {
+	return func(node *Node) {
+		node.workers = newWorkerPool(config)
+	}
+}
+
+// OptionBatchIO reads and writes up to size datagrams per system call on
+// Linux, with recvmmsg and sendmmsg, 64 if size is zero. It has no effect
+// on other systems or with OptionPacketConn.
+func OptionBatchIO(size int) NodeOption {
+	return func(node *Node) {
+		if size <= 0 {
+			size = defaultBatchSize
+		}
+		node.batchSize = size
+	}
+}
+
+// OptionSocketBuffers sets the kernel receive and send buffer sizes of
+// the node's UDP socket, zero keeps the system default. Crawlers need
+// large buffers to ride out bursts.
+func OptionSocketBuffers(read, write int) NodeOption {
+	return func(node *Node) {
+		node.readBuffer = read
+		node.writeBuffer = write
+	}
+}
+
+// OptionIPFilter replaces the default filter, which only blocks bogon
+// addresses, see IPFilter. A nil filter admits every address, as needed
+// to run nodes on loopback or a private network.
+func OptionIPFilter(f *IPFilter) NodeOption {
+	return func(node *Node) {
+		node.ipFilter = f
+	}
+}
+
+// OptionBanPolicy replaces DefaultBanPolicy, see BanPolicy. A zero
+// Threshold disables bans.
+func OptionBanPolicy(policy BanPolicy) NodeOption {
+	return func(node *Node) {
+		node.scores = newScoreboard(policy)
+	}
+}
+
+// OptionAmplificationLimits replaces DefaultAmplificationLimits, see
+// AmplificationLimits.
+func OptionAmplificationLimits(limits AmplificationLimits) NodeOption {
+	return func(node *Node) {
+		node.guard = newAmplificationGuard(limits)
+	}
+}
+
+// OptionCrawler replaces DefaultCrawlerConfig, see CrawlerConfig. A zero
+// Rate does not limit the crawler.
+func OptionCrawler(config CrawlerConfig) NodeOption {
+	return func(node *Node) {
+		node.crawler = newCrawler(config)
+	}
+}
+
+// OptionIdentities makes the node also present the given IDs, see
+// AddIdentity and SpreadNodeIDs. Start fails with ErrIdentityExists if an
+// ID is given twice or is the node's own ID.
+func OptionIdentities(ids ...NodeID) NodeOption {
+	return func(node *Node) {
+		node.identityIDs = append(node.identityIDs, ids...)
+	}
+}
+
+// OptionReusePort binds n sockets to the node's address with SO_REUSEPORT.
+// Every socket has its own reader and the kernel spreads the incoming
+// packets over them. Start fails with ErrReusePortUnsupported on platforms
+// without SO_REUSEPORT. It has no effect with OptionPacketConn.
+func OptionReusePort(n int) NodeOption {
+	return func(node *Node) {
+		node.sockets = n
+		node.reusePort = true
+	}
+}
+
+// OptionPortRange binds n sockets to n consecutive ports, starting at the
+// port of the node's address. Every socket has its own reader. It has no
+// effect with OptionPacketConn.
+func OptionPortRange(n int) NodeOption {
+	return func(node *Node) {
+		node.sockets = n
+		node.reusePort = false
+	}
+}
+
+// OptionEventHandler makes the node report its traffic to h, see
+// EventHandler. PeerHandler is still called when set.
+func OptionEventHandler(h EventHandler) NodeOption {
+	return func(node *Node) {
+		node.events = h
+	}
+}
+
+// OptionEventQueue configures the delivery of events, see EventQueue.
+func OptionEventQueue(config EventQueue) NodeOption {
+	return func(node *Node) {
+		node.eventQueue = newEventQueue(config)
+	}
+}
+
+// OptionLogger makes the node log to l, for example a *slog.Logger or
+// NewStdLogger(log.Default(), LevelInfo). Nothing is logged by default.
+func OptionLogger(l Logger) NodeOption {
+	return func(node *Node) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		node.logger = l
+	}
+}
+
+// OptionInterceptors adds interceptors to the handling of received
+// messages, see Interceptor. The first one runs first.
+func OptionInterceptors(interceptors ...Interceptor) NodeOption {
+	return func(node *Node) {
+		node.interceptors = append(node.interceptors, interceptors...)
+	}
+}
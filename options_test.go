@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingConn struct {
+	net.PacketConn
+	read, written int64
+}
+
+func (c *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		atomic.AddInt64(&c.read, 1)
+	}
+	return n, addr, err
+}
+
+func (c *countingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	atomic.AddInt64(&c.written, 1)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestOptionPacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	conn := &countingConn{PacketConn: pc}
+
+	node := newTestNode(t, OptionPacketConn(conn))
+	peer := newTestNode(t)
+
+	if err := node.Ping(peer.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&conn.read) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt64(&conn.written) == 0 || atomic.LoadInt64(&conn.read) == 0 {
+		t.Errorf("ping did not go through the packet conn: %d written, %d read", conn.written, conn.read)
+	}
+
+	node.Shutdown(context.Background())
+	if _, err := pc.WriteTo([]byte("x"), pc.LocalAddr()); err != nil {
+		t.Errorf("caller owned packet conn was closed: %v", err)
+	}
+	buf := make([]byte, 16)
+	if _, _, err := pc.ReadFrom(buf); err != nil {
+		t.Errorf("caller owned packet conn cannot be read: %v", err)
+	}
+}
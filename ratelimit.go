@@ -0,0 +1,301 @@
+package dht
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrRateLimited is returned when an outgoing packet is dropped because
+// its budget is exhausted.
+var ErrRateLimited = errors.New("rate limited")
+
+// limiterSweepInterval is how often idle per-address buckets are freed.
+const limiterSweepInterval = time.Minute
+
+// maxBuckets is the number of addresses a per-address limit, or the byte
+// budgets of the amplification guard, track, so that a flood of spoofed
+// sources cannot grow them. A full per-address limit forgets the address
+// it saw least recently to make room, the amplification guard refuses new
+// addresses until there is room.
+const maxBuckets = 1 << 16
+
+// RateLimit is a token bucket: Rate packets per second on average, with
+// bursts of up to Burst packets. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// burst is the size of the bucket, at least one packet.
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// RateLimits configures the traffic limits of a node, see
+// OptionRateLimits.
+type RateLimits struct {
+	// PerIP limits the incoming queries of every source IP.
+	PerIP RateLimit
+	// PerSubnet limits the incoming queries of every /24, or /64 for
+	// IPv6, so that a host cannot get around PerIP with many addresses.
+	PerSubnet RateLimit
+	// Outgoing limits every packet we send, queries and responses.
+	Outgoing RateLimit
+	// Queries gives the queries we send of each type a budget of their
+	// own, counted before Outgoing, so that e.g. crawling with find_node
+	// cannot starve announces.
+	Queries map[QueryType]RateLimit
+}
+
+// DefaultRateLimits are the limits of a node created without
+// OptionRateLimits. Outgoing traffic is not limited.
+var DefaultRateLimits = RateLimits{
+	PerIP:     RateLimit{Rate: 20, Burst: 50},
+	PerSubnet: RateLimit{Rate: 100, Burst: 250},
+}
+
+// RateLimitStats counts the packets dropped by the rate limits.
+type RateLimitStats struct {
+	// DroppedIP and DroppedSubnet are incoming queries over the PerIP
+	// and PerSubnet limits.
+	DroppedIP     uint64
+	DroppedSubnet uint64
+	// DroppedOutgoing are packets over the Outgoing limit.
+	DroppedOutgoing uint64
+	// DroppedQueries are outgoing queries over their type's budget.
+	DroppedQueries map[QueryType]uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time elapsed since the last call and
+// takes one token if there is one.
+func (b *tokenBucket) take(l RateLimit, now time.Time) bool {
+	b.refill(l, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(l RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.Rate
+	if b.tokens > l.burst() {
+		b.tokens = l.burst()
+	}
+	b.last = now
+}
+
+// bucketSet is a rate limit applied to every key on its own.
+type bucketSet struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// lru holds the *keyedBucket of every key, most recently used first
+	lru   *list.List
+	swept time.Time
+}
+
+type keyedBucket struct {
+	key string
+	tokenBucket
+}
+
+func newBucketSet(l RateLimit) *bucketSet {
+	return &bucketSet{limit: l, buckets: make(map[string]*list.Element), lru: list.New()}
+}
+
+// bucket returns the bucket of key, making room for it by forgetting the
+// least recently used key if the set is full. It must be called with
+// s.mu held.
+func (s *bucketSet) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(s.swept) > limiterSweepInterval {
+		s.sweep(now)
+	}
+
+	if e, ok := s.buckets[key]; ok {
+		s.lru.MoveToFront(e)
+		return &e.Value.(*keyedBucket).tokenBucket
+	}
+	if len(s.buckets) >= maxBuckets {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.buckets, oldest.Value.(*keyedBucket).key)
+	}
+	b := &keyedBucket{key: key, tokenBucket: tokenBucket{tokens: s.limit.burst(), last: now}}
+	s.buckets[key] = s.lru.PushFront(b)
+	return &b.tokenBucket
+}
+
+func (s *bucketSet) take(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bucket(key, now).take(s.limit, now)
+}
+
+// takeWith takes a token from the bucket of key and one from the bucket
+// of otherKey in other, or none if either is empty, and reports which
+// had one. A nil set has no limit. Both sets stay locked from the check
+// to the take, s first, so concurrent callers cannot overdraw them.
+func (s *bucketSet) takeWith(key string, other *bucketSet, otherKey string, now time.Time) (ok, otherOK bool) {
+	var b, ob *tokenBucket
+	ok, otherOK = true, true
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		b = s.bucket(key, now)
+		b.refill(s.limit, now)
+		ok = b.tokens >= 1
+	}
+	if other != nil {
+		other.mu.Lock()
+		defer other.mu.Unlock()
+		ob = other.bucket(otherKey, now)
+		ob.refill(other.limit, now)
+		otherOK = ob.tokens >= 1
+	}
+
+	if ok && otherOK {
+		if b != nil {
+			b.tokens--
+		}
+		if ob != nil {
+			ob.tokens--
+		}
+	}
+	return ok, otherOK
+}
+
+// sweep frees the buckets that are full again, they behave exactly like
+// new ones.
+func (s *bucketSet) sweep(now time.Time) {
+	for key, e := range s.buckets {
+		b := e.Value.(*keyedBucket)
+		b.refill(s.limit, now)
+		if b.tokens >= s.limit.burst() {
+			s.lru.Remove(e)
+			delete(s.buckets, key)
+		}
+	}
+	s.swept = now
+}
+
+type rateLimiter struct {
+	droppedIP       uint64
+	droppedSubnet   uint64
+	droppedOutgoing uint64
+	droppedQueries  map[QueryType]*uint64
+
+	perIP     *bucketSet
+	perSubnet *bucketSet
+	outgoing  *bucketSet
+	queries   map[QueryType]*bucketSet
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	l := &rateLimiter{
+		queries:        make(map[QueryType]*bucketSet),
+		droppedQueries: make(map[QueryType]*uint64),
+	}
+	if limits.PerIP.enabled() {
+		l.perIP = newBucketSet(limits.PerIP)
+	}
+	if limits.PerSubnet.enabled() {
+		l.perSubnet = newBucketSet(limits.PerSubnet)
+	}
+	if limits.Outgoing.enabled() {
+		l.outgoing = newBucketSet(limits.Outgoing)
+	}
+	for q, limit := range limits.Queries {
+		if limit.enabled() {
+			l.queries[q] = newBucketSet(limit)
+			l.droppedQueries[q] = new(uint64)
+		}
+	}
+	return l
+}
+
+// subnet returns the /24 of an IPv4 address or the /64 of an IPv6 one.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4.Mask(net.CIDRMask(24, 32)))
+	}
+	return string(ip.Mask(net.CIDRMask(64, 128)))
+}
+
+// allowIncoming reports whether a query from ip is within the per IP and
+// per subnet limits. Tokens are only taken when both limits allow it, so
+// a dropped query does not cost the source anything.
+func (l *rateLimiter) allowIncoming(ip net.IP) bool {
+	ipOK, subnetOK := l.perIP.takeWith(string(ip.To16()), l.perSubnet, subnet(ip), time.Now())
+	if !ipOK {
+		atomic.AddUint64(&l.droppedIP, 1)
+		return false
+	}
+	if !subnetOK {
+		atomic.AddUint64(&l.droppedSubnet, 1)
+		return false
+	}
+	return true
+}
+
+// allowQuery reports whether an outgoing query of type q is within its
+// budget.
+func (l *rateLimiter) allowQuery(q QueryType) bool {
+	s, ok := l.queries[q]
+	if !ok {
+		return true
+	}
+	if !s.take("", time.Now()) {
+		atomic.AddUint64(l.droppedQueries[q], 1)
+		return false
+	}
+	return true
+}
+
+// allowOutgoing reports whether one more packet can be sent.
+func (l *rateLimiter) allowOutgoing() bool {
+	if l.outgoing == nil {
+		return true
+	}
+	if !l.outgoing.take("", time.Now()) {
+		atomic.AddUint64(&l.droppedOutgoing, 1)
+		return false
+	}
+	return true
+}
+
+func (l *rateLimiter) stats() RateLimitStats {
+	stats := RateLimitStats{
+		DroppedIP:       atomic.LoadUint64(&l.droppedIP),
+		DroppedSubnet:   atomic.LoadUint64(&l.droppedSubnet),
+		DroppedOutgoing: atomic.LoadUint64(&l.droppedOutgoing),
+		DroppedQueries:  make(map[QueryType]uint64, len(l.droppedQueries)),
+	}
+	for q, n := range l.droppedQueries {
+		stats.DroppedQueries[q] = atomic.LoadUint64(n)
+	}
+	return stats
+}
+
+// RateLimitStats returns the number of packets dropped by the rate
+// limits so far.
+func (node *Node) RateLimitStats() RateLimitStats {
+	return node.limiter.stats()
+}
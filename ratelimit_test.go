@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBucketSet(t *testing.T) {
+	s := newBucketSet(RateLimit{Rate: 10, Burst: 5})
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if !s.take("a", now) {
+			t.Fatalf("packet %d of the burst was dropped", i)
+		}
+	}
+	if s.take("a", now) {
+		t.Error("packet over the burst was allowed")
+	}
+	if !s.take("b", now) {
+		t.Error("keys share a bucket")
+	}
+	if !s.take("a", now.Add(150*time.Millisecond)) {
+		t.Error("bucket was not refilled")
+	}
+
+	s.sweep(now.Add(time.Hour))
+	if len(s.buckets) != 0 {
+		t.Errorf("%d idle buckets left after sweep", len(s.buckets))
+	}
+}
+
+func TestBucketSetCapacity(t *testing.T) {
+	s := newBucketSet(RateLimit{Rate: 0.001, Burst: 1})
+	now := time.Now()
+
+	for i := 0; i < maxBuckets; i++ {
+		if !s.take(fmt.Sprint(i), now) {
+			t.Fatalf("key %d refused below the capacity", i)
+		}
+	}
+	s.take("1", now)
+	if !s.take("new", now) {
+		t.Error("new key refused in a full set")
+	}
+	if len(s.buckets) != maxBuckets {
+		t.Errorf("%d buckets, want %d", len(s.buckets), maxBuckets)
+	}
+	if _, ok := s.buckets["0"]; ok {
+		t.Error("the least recently used key was not forgotten")
+	}
+	if s.take("1", now) {
+		t.Error("a recently used key was forgotten")
+	}
+}
+
+func TestIncomingLimitsCheckedFirst(t *testing.T) {
+	l := newRateLimiter(RateLimits{PerIP: RateLimit{Rate: 0.001, Burst: 2}, PerSubnet: RateLimit{Rate: 0.001, Burst: 1}})
+	a, b := net.IPv4(1, 2, 3, 4), net.IPv4(1, 2, 3, 5)
+
+	if !l.allowIncoming(b) {
+		t.Fatal("first query of the subnet dropped")
+	}
+	for i := 0; i < 3; i++ {
+		if l.allowIncoming(a) {
+			t.Fatal("query over the subnet limit allowed")
+		}
+	}
+	key, now := string(a.To16()), time.Now()
+	if !l.perIP.take(key, now) || !l.perIP.take(key, now) {
+		t.Error("queries dropped by the subnet limit took per IP tokens")
+	}
+}
+
+func TestIncomingLimitsConcurrent(t *testing.T) {
+	l := newRateLimiter(RateLimits{PerIP: RateLimit{Rate: 0.001, Burst: 10}, PerSubnet: RateLimit{Rate: 0.001, Burst: 100}})
+	ip := net.IPv4(1, 2, 3, 4)
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if l.allowIncoming(ip) {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 10 {
+		t.Errorf("%d queries allowed concurrently, want the burst of 10", allowed)
+	}
+}
+
+func TestIncomingRateLimit(t *testing.T) {
+	node := newTestNode(t, OptionRateLimits(RateLimits{PerIP: RateLimit{Rate: 0.01, Burst: 2}}))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ping, err := (&KRPCQuery{T: []byte("aa"), Q: PingType, NID: GenerateNodeID()}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := conn.WriteTo(ping, node.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var answers int
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		// the node also pings us back to verify our address
+		if messageType(buf[:n]) == "r" {
+			answers++
+		}
+	}
+
+	if answers != 2 {
+		t.Errorf("%d pings answered, want 2", answers)
+	}
+	if n := node.RateLimitStats().DroppedIP; n != 8 {
+		t.Errorf("%d pings dropped, want 8", n)
+	}
+}
+
+func messageType(b []byte) string {
+	msg, err := NewKRPCMessage(b)
+	if err != nil {
+		return ""
+	}
+	return msg.Y
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package dht
+
+import (
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return ErrReusePortUnsupported
+}
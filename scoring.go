@@ -0,0 +1,307 @@
+package dht
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bttown/routing-table"
+)
+
+// ErrBanned is returned when a packet is not sent because the
+// destination is banned.
+var ErrBanned = errors.New("address banned")
+
+// BanPolicy configures the scoring of misbehaving remotes, see
+// OptionBanPolicy. Every offense adds penalty points to the score of the
+// remote IP, and scores halve every HalfLife. A remote whose score
+// reaches Threshold is banned for TTL: its packets are dropped and it is
+// neither queried nor stored.
+//
+// The source of a packet can be spoofed, so offenses in packets anyone
+// could send raise a score to half the Threshold at most. Only offenses
+// in the answers to our queries, which carry our random transaction id,
+// get a remote banned. The bootstrap routers are never banned.
+type BanPolicy struct {
+	Threshold float64
+	HalfLife  time.Duration
+	TTL       time.Duration
+	// RejectInvalidTokens answers the announce_peer queries whose token we
+	// did not give out with a protocol error. By default they are scored
+	// but still reach the EventHandler and PeerHandler, with
+	// AnnounceEvent.ValidToken false, since many peers announce without
+	// a get_peers first.
+	RejectInvalidTokens bool
+}
+
+// DefaultBanPolicy is the policy of a node created without
+// OptionBanPolicy.
+var DefaultBanPolicy = BanPolicy{
+	Threshold: 100,
+	HalfLife:  10 * time.Minute,
+	TTL:       time.Hour,
+}
+
+// Offense is a kind of misbehavior that is scored.
+type Offense string
+
+const (
+	// OffenseMalformed is a packet that is not a valid KRPC message.
+	OffenseMalformed Offense = "malformed packet"
+	// OffenseUnsolicited is a response to a query we did not send.
+	OffenseUnsolicited Offense = "unsolicited response"
+	// OffenseInvalidToken is an announce_peer with a token we did not
+	// give to the remote.
+	OffenseInvalidToken Offense = "invalid token"
+	// OffenseIDMismatch is a node ID we know at another address.
+	OffenseIDMismatch Offense = "node ID bound to another address"
+	// OffenseBogusNodes is a nodes list with filtered addresses.
+	OffenseBogusNodes Offense = "bogus nodes"
+	// OffenseFlood is a query over the rate limits.
+	OffenseFlood Offense = "flood"
+)
+
+var penalties = map[Offense]float64{
+	OffenseMalformed:    20,
+	OffenseUnsolicited:  10,
+	OffenseInvalidToken: 25,
+	OffenseIDMismatch:   15,
+	OffenseBogusNodes:   5,
+	OffenseFlood:        1,
+}
+
+// Ban is a remote IP that is ignored until Until.
+type Ban struct {
+	IP     net.IP
+	Until  time.Time
+	Reason Offense
+}
+
+type score struct {
+	points  float64
+	updated time.Time
+}
+
+type scoreboard struct {
+	policy BanPolicy
+
+	mu     sync.Mutex
+	scores map[string]*score
+	bans   map[string]*Ban
+	exempt map[string]bool
+	swept  time.Time
+}
+
+func newScoreboard(policy BanPolicy) *scoreboard {
+	return &scoreboard{
+		policy: policy,
+		scores: make(map[string]*score),
+		bans:   make(map[string]*Ban),
+		exempt: make(map[string]bool),
+	}
+}
+
+func ipKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+// decay returns the points of s at now.
+func (b *scoreboard) decay(s *score, now time.Time) float64 {
+	if b.policy.HalfLife <= 0 {
+		return s.points
+	}
+	halves := float64(now.Sub(s.updated)) / float64(b.policy.HalfLife)
+	return s.points * math.Pow(0.5, halves)
+}
+
+// penalize adds the points of offense to the score of ip, banning it if
+// the score reaches the threshold. Unless the offense is proven to come
+// from ip, the score is not raised above half the threshold. It returns
+// the new ban, if any.
+func (b *scoreboard) penalize(ip net.IP, offense Offense, proven bool) *Ban {
+	now := time.Now()
+	key := ipKey(ip)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.exempt[key] {
+		return nil
+	}
+
+	if now.Sub(b.swept) > b.policy.HalfLife {
+		b.sweep(now)
+	}
+
+	s, ok := b.scores[key]
+	if !ok {
+		s = &score{}
+		b.scores[key] = s
+	}
+	points := b.decay(s, now)
+	if proven {
+		points += penalties[offense]
+	} else if limit := b.policy.Threshold / 2; points < limit {
+		points = math.Min(points+penalties[offense], limit)
+	}
+	s.points = points
+	s.updated = now
+
+	if b.policy.Threshold <= 0 || s.points < b.policy.Threshold {
+		return nil
+	}
+	delete(b.scores, key)
+	ban := &Ban{
+		IP:     append(net.IP(nil), ip.To16()...),
+		Until:  now.Add(b.policy.TTL),
+		Reason: offense,
+	}
+	b.bans[key] = ban
+	return ban
+}
+
+// sweep forgets scores that decayed to nothing and expired bans.
+func (b *scoreboard) sweep(now time.Time) {
+	for key, s := range b.scores {
+		if b.decay(s, now) < 1 {
+			delete(b.scores, key)
+		}
+	}
+	for key, ban := range b.bans {
+		if now.After(ban.Until) {
+			delete(b.bans, key)
+		}
+	}
+	b.swept = now
+}
+
+func (b *scoreboard) banned(ip net.IP) bool {
+	key := ipKey(ip)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Until) {
+		delete(b.bans, key)
+		return false
+	}
+	return true
+}
+
+func (b *scoreboard) ban(ip net.IP, ttl time.Duration, reason Offense) {
+	b.mu.Lock()
+	b.bans[ipKey(ip)] = &Ban{
+		IP:     append(net.IP(nil), ip.To16()...),
+		Until:  time.Now().Add(ttl),
+		Reason: reason,
+	}
+	b.mu.Unlock()
+}
+
+// exemptIP makes ip immune to penalties, for the bootstrap routers.
+func (b *scoreboard) exemptIP(ip net.IP) {
+	b.mu.Lock()
+	b.exempt[ipKey(ip)] = true
+	b.mu.Unlock()
+}
+
+func (b *scoreboard) unban(ip net.IP) {
+	b.mu.Lock()
+	delete(b.bans, ipKey(ip))
+	delete(b.scores, ipKey(ip))
+	b.mu.Unlock()
+}
+
+func (b *scoreboard) list() []Ban {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+func (b *scoreboard) score(ip net.IP) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.scores[ipKey(ip)]
+	if !ok {
+		return 0
+	}
+	return b.decay(s, time.Now())
+}
+
+// Bans returns the remotes banned for misbehaving, or with Ban, soonest
+// to expire first.
+func (node *Node) Bans() []Ban {
+	return node.scores.list()
+}
+
+// Ban bans ip for ttl.
+func (node *Node) Ban(ip net.IP, ttl time.Duration, reason Offense) {
+	node.scores.ban(ip, ttl, reason)
+}
+
+// Unban lifts the ban of ip and resets its score.
+func (node *Node) Unban(ip net.IP) {
+	node.scores.unban(ip)
+}
+
+// Score returns the current penalty points of ip.
+func (node *Node) Score(ip net.IP) float64 {
+	return node.scores.score(ip)
+}
+
+// penalize scores an offense in a packet from addr, which may have been
+// sent by anyone.
+func (node *Node) penalize(addr *net.UDPAddr, offense Offense) {
+	node.scores.penalize(addr.IP, offense, false)
+}
+
+// penalizeResponder scores an offense in the answer of addr to one of
+// our queries.
+func (node *Node) penalizeResponder(addr *net.UDPAddr, offense Offense) {
+	if ban := node.scores.penalize(addr.IP, offense, true); ban != nil {
+		node.logger.Warn("ban", "remote", addr, "offense", offense, "until", ban.Until)
+	}
+}
+
+// boundElsewhere reports whether the routing table of the node or of one
+// of its identities knows id at an address other than addr.
+func (node *Node) boundElsewhere(id NodeID, addr *net.UDPAddr) bool {
+	if id == (NodeID{}) {
+		return false
+	}
+	tables := []*table.Table{node.table}
+	for _, ident := range node.identities.all() {
+		tables = append(tables, ident.table)
+	}
+	for _, t := range tables {
+		entries := t.Closest(table.Hash(id), 1).Entries()
+		if len(entries) == 0 || NodeID(entries[0].NID) != id {
+			continue
+		}
+		known := entries[0].UDPAddr
+		if !known.IP.Equal(addr.IP) || known.Port != addr.Port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestScoreboard(t *testing.T) {
+	b := newScoreboard(BanPolicy{Threshold: 50, HalfLife: time.Hour, TTL: time.Minute})
+	ip := net.IPv4(1, 2, 3, 4)
+
+	b.penalize(ip, OffenseMalformed, true)
+	b.penalize(ip, OffenseMalformed, true)
+	if b.banned(ip) {
+		t.Fatal("banned below the threshold")
+	}
+	if s := b.score(ip); s < 39 || s > 40 {
+		t.Errorf("score %v, want 40", s)
+	}
+
+	b.penalize(ip, OffenseInvalidToken, true)
+	if !b.banned(ip) {
+		t.Fatal("not banned above the threshold")
+	}
+	bans := b.list()
+	if len(bans) != 1 || !bans[0].IP.Equal(ip) || bans[0].Reason != OffenseInvalidToken {
+		t.Errorf("unexpected bans %+v", bans)
+	}
+
+	b.unban(ip)
+	if b.banned(ip) || b.score(ip) != 0 {
+		t.Error("unban did not reset the remote")
+	}
+
+	s := &score{points: 80, updated: time.Now().Add(-2 * time.Hour)}
+	if p := b.decay(s, time.Now()); p < 19 || p > 21 {
+		t.Errorf("score decayed to %v after two half lives, want 20", p)
+	}
+}
+
+func TestSpoofableOffenses(t *testing.T) {
+	b := newScoreboard(BanPolicy{Threshold: 50, HalfLife: time.Hour, TTL: time.Minute})
+	ip := net.IPv4(1, 2, 3, 4)
+
+	for i := 0; i < 10; i++ {
+		b.penalize(ip, OffenseMalformed, false)
+	}
+	if b.banned(ip) {
+		t.Fatal("banned for offenses anyone could have sent")
+	}
+	if s := b.score(ip); s > 25 {
+		t.Errorf("score %v, want at most half the threshold", s)
+	}
+	b.penalize(ip, OffenseInvalidToken, true)
+	b.penalize(ip, OffenseInvalidToken, true)
+	if !b.banned(ip) {
+		t.Error("not banned above the threshold")
+	}
+
+	router := net.IPv4(5, 6, 7, 8)
+	b.exemptIP(router)
+	for i := 0; i < 10; i++ {
+		b.penalize(router, OffenseBogusNodes, true)
+	}
+	if b.banned(router) || b.score(router) != 0 {
+		t.Error("router penalized")
+	}
+}
+
+func TestUnsolicitedResponsesDoNotBan(t *testing.T) {
+	node := newTestNode(t, OptionBanPolicy(BanPolicy{Threshold: 30, HalfLife: time.Hour, TTL: time.Hour}))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := (&KRPCResponse{T: []byte("zz"), Q: PingType, QueriedID: GenerateNodeID()}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		conn.WriteTo(resp, node.LocalAddr())
+	}
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	deadline := time.Now().Add(5 * time.Second)
+	for node.Score(ip) < 14 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := node.Score(ip); s < 14 || s > 15 {
+		t.Errorf("score %v, want half the threshold", s)
+	}
+	if bans := node.Bans(); len(bans) != 0 {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+	if len(node.Contacts()) != 0 {
+		t.Error("unsolicited response was added to the routing table")
+	}
+}
+
+// announceForged sends node an announce_peer with a token it did not
+// give out and returns the message type of the reply.
+func announceForged(t *testing.T, node *Node) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	query, err := (&KRPCQuery{
+		T:        []byte("aa"),
+		Q:        AnnouncePeerType,
+		NID:      GenerateNodeID(),
+		InfoHash: make([]byte, 20),
+		Port:     6881,
+		Token:    "forged",
+	}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(query, node.LocalAddr())
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no reply received:", err)
+		}
+		if y := messageType(buf[:n]); y != "q" {
+			return y
+		}
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	events := make(chan AnnounceEvent, 1)
+	node := newTestNode(t, OptionEventHandler(&recorder{announces: events}))
+
+	if y := announceForged(t, node); y != "r" {
+		t.Fatalf("got a %q reply to a forged token, want a response", y)
+	}
+	select {
+	case e := <-events:
+		if e.ValidToken {
+			t.Error("forged token reported valid")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("announce with a forged token did not reach the event handler")
+	}
+	if node.Score(net.IPv4(127, 0, 0, 1)) == 0 {
+		t.Error("forged token was not scored")
+	}
+}
+
+func TestRejectInvalidTokens(t *testing.T) {
+	announced := make(chan struct{}, 1)
+	policy := DefaultBanPolicy
+	policy.RejectInvalidTokens = true
+	node := newTestNode(t, OptionBanPolicy(policy), func(node *Node) {
+		node.PeerHandler = func(ip string, port int, infoHash, peerID string) {
+			announced <- struct{}{}
+		}
+	})
+
+	if y := announceForged(t, node); y != "e" {
+		t.Fatalf("got a %q reply to a forged token, want an error", y)
+	}
+	select {
+	case <-announced:
+		t.Error("announce with a forged token reached PeerHandler")
+	default:
+	}
+}
+
+func TestTransactionKey(t *testing.T) {
+	a := transactionKey([]byte("x1"), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881})
+	b := transactionKey([]byte("x"), &net.UDPAddr{IP: net.IPv4(11, 2, 3, 4), Port: 6881})
+	if a == b {
+		t.Errorf("ambiguous transaction key %q", a)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := string(defaultTokenManager.GenToken())
+		if len(id) < 4 || seen[id] {
+			t.Fatalf("transaction id %x reused or too short", id)
+		}
+		seen[id] = true
+	}
+}
+
+func pendingTransactions(node *Node) int {
+	node.transactions.mu.Lock()
+	defer node.transactions.mu.Unlock()
+	return len(node.transactions.pending)
+}
+
+func TestUnsentQueriesForgotten(t *testing.T) {
+	filtered := newTestNode(t, OptionIPFilter(NewIPFilter(true)))
+	if err := filtered.Ping(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}); err != ErrIPFiltered {
+		t.Fatalf("got %v pinging a filtered address, want ErrIPFiltered", err)
+	}
+	if n := pendingTransactions(filtered); n != 0 {
+		t.Errorf("%d transactions pending after a refused write", n)
+	}
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	node := newTestNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := node.Call(ctx, silent.LocalAddr().(*net.UDPAddr), &KRPCQuery{Q: PingType}); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if n := pendingTransactions(node); n != 0 {
+		t.Errorf("%d transactions pending after Call gave up", n)
+	}
+}
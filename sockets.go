@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrReusePortUnsupported is returned by Start when OptionReusePort is
+// used on a platform without SO_REUSEPORT.
+var ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// listen binds the node's sockets: one, n sharing the port with
+// SO_REUSEPORT, or n on consecutive ports.
+func (node *Node) listen() ([]net.PacketConn, error) {
+	n := node.sockets
+	if n < 1 {
+		n = 1
+	}
+
+	conns := make([]net.PacketConn, 0, n)
+	addr := node.localUDPAddr
+	for i := 0; i < n; i++ {
+		udpConn, err := node.listenUDP(&addr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		if err := setSocketBuffers(udpConn, node.readBuffer, node.writeBuffer); err != nil {
+			node.logger.Warn("set socket buffers", "local", udpConn.LocalAddr(), "err", err)
+		}
+		conns = append(conns, newBatchConn(udpConn, node.batchSize, node.logger))
+
+		// the first socket picks the port when it is 0
+		if i == 0 {
+			addr.Port = udpConn.LocalAddr().(*net.UDPAddr).Port
+		}
+		if !node.reusePort {
+			addr.Port++
+		}
+	}
+	return conns, nil
+}
+
+func (node *Node) listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if !node.reusePort {
+		return net.ListenUDP(node.NetWork, addr)
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	pc, err := lc.ListenPacket(context.Background(), node.NetWork, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// LocalAddrs returns the addresses of all the node's sockets, or nil if it
+// is not running.
+func (node *Node) LocalAddrs() []net.Addr {
+	var addrs []net.Addr
+	for _, conn := range node.conns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	return addrs
+}
@@ -0,0 +1,92 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// pingFrom pings addr from conn and returns the source of the response.
+func pingFrom(t *testing.T, conn net.PacketConn, addr net.Addr) net.Addr {
+	ping, err := (&KRPCQuery{T: []byte("aa"), Q: PingType, NID: GenerateNodeID()}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(ping, addr)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no ping response:", err)
+		}
+		if messageType(buf[:n]) == "r" {
+			return from
+		}
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	node := NewNode(testNodeOptions(OptionPortRange(3))...)
+	if err := node.Start(context.Background()); err != nil {
+		t.Skip("cannot bind consecutive ports:", err)
+	}
+	defer node.Shutdown(context.Background())
+
+	addrs := node.LocalAddrs()
+	if len(addrs) != 3 {
+		t.Fatalf("%d sockets, want 3", len(addrs))
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	first := addrs[0].(*net.UDPAddr).Port
+	for i, addr := range addrs {
+		if port := addr.(*net.UDPAddr).Port; port != first+i {
+			t.Errorf("socket %d on port %d, want %d", i, port, first+i)
+		}
+		if from := pingFrom(t, conn, addr); from.String() != addr.String() {
+			t.Errorf("ping to %v answered from %v", addr, from)
+		}
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	node := NewNode(testNodeOptions(OptionReusePort(4))...)
+	err := node.Start(context.Background())
+	if err == ErrReusePortUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Shutdown(context.Background())
+
+	addrs := node.LocalAddrs()
+	if len(addrs) != 4 {
+		t.Fatalf("%d sockets, want 4", len(addrs))
+	}
+	for _, addr := range addrs[1:] {
+		if addr.String() != addrs[0].String() {
+			t.Errorf("socket bound to %v, want %v", addr, addrs[0])
+		}
+	}
+
+	// the kernel picks the socket by the source address
+	for i := 0; i < 8; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from := pingFrom(t, conn, addrs[0]); from.String() != addrs[0].String() {
+			t.Errorf("ping answered from %v", from)
+		}
+		conn.Close()
+	}
+}
@@ -1,7 +1,10 @@
 package dht
 
 import (
-	"math/rand"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
 	"time"
 )
 
@@ -10,10 +13,96 @@ type TokenManager struct {
 
 var defaultTokenManager = new(TokenManager)
 
+// GenToken returns a new transaction id. Answers are matched by the id,
+// so it is random enough for concurrent queries to the same address not to
+// collide and for off-path remotes not to guess it.
 func (*TokenManager) GenToken() []byte {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	buf := make([]byte, 2)
-	r.Read(buf)
+	buf := make([]byte, 4)
+	crand.Read(buf)
 
 	return buf
 }
+
+// writeTokenRotation is how often the secret of the write tokens changes.
+// Tokens of the previous secret are still accepted, so a token is valid
+// for 5 to 10 minutes, as BEP 5 suggests.
+const writeTokenRotation = 5 * time.Minute
+
+// writeTokens issues the tokens returned to get_peers queries and checks
+// the ones presented in announce_peer. A token is a hash of the querying
+// IP and a secret that rotates, so it only works from the address it was
+// given to.
+type writeTokens struct {
+	mu       sync.Mutex
+	secret   [8]byte
+	previous [8]byte
+	rotated  time.Time
+}
+
+func newWriteTokens() *writeTokens {
+	w := &writeTokens{rotated: time.Now()}
+	crand.Read(w.secret[:])
+	w.previous = w.secret
+	return w
+}
+
+func (w *writeTokens) rotate(now time.Time) {
+	for now.Sub(w.rotated) >= writeTokenRotation {
+		w.previous = w.secret
+		crand.Read(w.secret[:])
+		w.rotated = w.rotated.Add(writeTokenRotation)
+	}
+}
+
+func writeToken(secret [8]byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.To16())
+	return string(h.Sum(nil)[:8])
+}
+
+func (w *writeTokens) issue(ip net.IP) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rotate(time.Now())
+	return writeToken(w.secret, ip)
+}
+
+func (w *writeTokens) valid(token string, ip net.IP) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rotate(time.Now())
+	return token == writeToken(w.secret, ip) || token == writeToken(w.previous, ip)
+}
+
+// tokenSecrets are the secrets of the write tokens, saved in the routing
+// table dump so that the tokens we gave out stay valid across a restart.
+type tokenSecrets struct {
+	secret   [8]byte
+	previous [8]byte
+	rotated  time.Time
+}
+
+func (w *writeTokens) secrets() tokenSecrets {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rotate(time.Now())
+	return tokenSecrets{secret: w.secret, previous: w.previous, rotated: w.rotated}
+}
+
+// restore adopts saved secrets, unless both expired.
+func (w *writeTokens) restore(s tokenSecrets) {
+	now := time.Now()
+	if s.rotated.IsZero() || now.Sub(s.rotated) >= 2*writeTokenRotation || s.rotated.After(now) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.secret, w.previous, w.rotated = s.secret, s.previous, s.rotated
+	w.rotate(now)
+}
@@ -0,0 +1,122 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// transactionTimeout is how long we wait for the answer to a query.
+// Answers arriving later are treated as unsolicited.
+const transactionTimeout = 30 * time.Second
+
+var (
+	// ErrTimeout is returned by Call when no answer arrived in time.
+	ErrTimeout = errors.New("query timed out")
+	// ErrIDMismatch is returned by Call when the response came with a node
+	// ID the routing table knows at another address.
+	ErrIDMismatch = errors.New("node ID bound to another address")
+)
+
+type transaction struct {
+	q        QueryType
+	id       NodeID
+	deadline time.Time
+	// reply receives the answer of a query sent with Node.Call, it must
+	// have room for it
+	reply chan<- answer
+	// crawl marks the find_node queries of the crawler, whose answers
+	// drive its rate
+	crawl bool
+}
+
+// answer is a response or a KRPC error.
+type answer struct {
+	r   *KRPCResponse
+	err error
+}
+
+// answer passes a to the waiter of the query, if any. A transaction is
+// answered once, when it is taken from the pending queries.
+func (tx *transaction) answer(a answer) {
+	if tx.reply == nil {
+		return
+	}
+	select {
+	case tx.reply <- a:
+	default:
+	}
+}
+
+// transactions remembers the queries we sent, keyed by transaction id and
+// remote address, to tell answers from unsolicited responses.
+type transactions struct {
+	mu      sync.Mutex
+	pending map[string]*transaction
+	swept   time.Time
+}
+
+func newTransactions() *transactions {
+	return &transactions{pending: make(map[string]*transaction)}
+}
+
+// transactionKey puts the address first, it has no "/", so that no two
+// pairs of id and address give the same key.
+func transactionKey(t []byte, addr *net.UDPAddr) string {
+	return addr.String() + "/" + string(t)
+}
+
+// add remembers the query tx with transaction id t sent to addr.
+func (ts *transactions) add(t []byte, addr *net.UDPAddr, tx *transaction) {
+	now := time.Now()
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if now.Sub(ts.swept) > transactionTimeout {
+		for k, tx := range ts.pending {
+			if now.After(tx.deadline) {
+				delete(ts.pending, k)
+				tx.answer(answer{err: ErrTimeout})
+			}
+		}
+		ts.swept = now
+	}
+	tx.deadline = now.Add(transactionTimeout)
+	ts.pending[transactionKey(t, addr)] = tx
+}
+
+// remove forgets the query tx with transaction id t sent to addr, when
+// it could not be sent or its caller stopped waiting, so that a later
+// packet with the same id is not taken for its answer.
+func (ts *transactions) remove(t []byte, addr *net.UDPAddr, tx *transaction) {
+	key := transactionKey(t, addr)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.pending[key] == tx {
+		delete(ts.pending, key)
+	}
+}
+
+// take returns and forgets the pending query answered by a message with
+// transaction id t from addr, or nil if there is none.
+func (ts *transactions) take(t []byte, addr *net.UDPAddr) *transaction {
+	key := transactionKey(t, addr)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tx, ok := ts.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(ts.pending, key)
+	if time.Now().After(tx.deadline) {
+		tx.answer(answer{err: ErrTimeout})
+		return nil
+	}
+	return tx
+}
@@ -0,0 +1,685 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	stateSynSent = iota + 1
+	stateConnected
+	stateClosed
+)
+
+const (
+	// mss is the largest payload we put in a single packet, small enough
+	// to avoid IP fragmentation on common paths.
+	mss = 1200
+
+	minWindow     = mss
+	initialWindow = 3 * mss
+	maxWindowCap  = 1 << 20
+
+	// CCONTROL_TARGET and MAX_CWND_INCREASE_BYTES_PER_RTT from BEP 29.
+	targetDelay           = 100000
+	maxCwndIncreasePerRTT = 3000
+
+	recvWindow    = 1 << 20
+	sendBufferMax = 1 << 20
+	reorderLimit  = 512
+
+	initialTimeout    = time.Second
+	minTimeout        = 500 * time.Millisecond
+	maxTimeout        = 30 * time.Second
+	maxRetransmits    = 6
+	maxSynRetransmits = 3
+	keepAliveInterval = 29 * time.Second
+	lingerTimeout     = 10 * time.Second
+	tickInterval      = 50 * time.Millisecond
+)
+
+var errClosed = errors.New("utp: use of closed connection")
+
+var epoch = time.Now()
+
+// now returns the current time in microseconds, truncated to 32 bits as
+// carried in the packet header.
+func now() uint32 {
+	return uint32(time.Since(epoch) / time.Microsecond)
+}
+
+type outPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	needResend    bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	sock   *Socket
+	raddr  net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu    sync.Mutex
+	state int
+	err   error
+
+	seqNr     uint16 // next sequence number to send
+	ackNr     uint16 // last sequence number received in order
+	peerWnd   uint32
+	replyDiff uint32
+	lastSend  time.Time
+
+	// send side
+	writeBuf    []byte
+	outq        []*outPacket
+	curWindow   int
+	maxWindow   float64
+	lastAck     uint16
+	dupAcks     int
+	retransmits int
+	rtt         time.Duration
+	rttVar      time.Duration
+	rto         time.Duration
+
+	baseDelayCur   uint32
+	baseDelayPrev  uint32
+	baseDelayStart time.Time
+
+	// receive side
+	readBuf bytes.Buffer
+	reorder map[uint16][]byte
+	gotFin  bool
+	eofSeq  uint16
+	readEOF bool
+
+	appClosed  bool
+	finSent    bool
+	finAckedAt time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+	connected     chan struct{}
+	done          chan struct{}
+
+	ownSocket bool
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID, seqNr uint16) *Conn {
+	return &Conn{
+		sock:          s,
+		raddr:         raddr,
+		recvID:        recvID,
+		sendID:        sendID,
+		seqNr:         seqNr,
+		peerWnd:       recvWindow,
+		maxWindow:     initialWindow,
+		rto:           initialTimeout,
+		baseDelayCur:  math.MaxUint32,
+		baseDelayPrev: math.MaxUint32,
+		reorder:       make(map[uint16][]byte),
+		readNotify:    make(chan struct{}, 1),
+		writeNotify:   make(chan struct{}, 1),
+		connected:     make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) loop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			c.tick()
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *Conn) tick() {
+	if c.state == stateClosed {
+		return
+	}
+
+	t := time.Now()
+	if len(c.outq) > 0 && t.Sub(c.outq[0].sentAt) >= c.rto {
+		c.onTimeout()
+		return
+	}
+
+	if c.state == stateConnected && t.Sub(c.lastSend) >= keepAliveInterval {
+		c.sendState()
+	}
+
+	if c.finSent && len(c.outq) == 0 && t.Sub(c.finAckedAt) >= lingerTimeout {
+		c.destroyLocked(nil)
+	}
+}
+
+// onTimeout implements the BEP 29 timeout rule: the window collapses to
+// one packet, the timeout doubles and everything in flight is resent.
+func (c *Conn) onTimeout() {
+	c.retransmits++
+	limit := maxRetransmits
+	if c.state == stateSynSent {
+		limit = maxSynRetransmits
+	}
+	if c.retransmits > limit {
+		c.destroyLocked(ErrTimeout)
+		return
+	}
+
+	c.maxWindow = minWindow
+	c.rto *= 2
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+
+	for _, p := range c.outq {
+		if !p.needResend {
+			p.needResend = true
+			c.curWindow -= len(p.payload)
+		}
+	}
+	c.flush()
+}
+
+func (c *Conn) handlePacket(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.replyDiff = now() - h.timestamp
+
+	if h.typ == stReset {
+		c.destroyLocked(ErrReset)
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.ackNr = h.seqNr - 1
+		c.state = stateConnected
+		close(c.connected)
+	}
+
+	c.peerWnd = h.wndSize
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.processData(h, payload)
+	}
+
+	c.flush()
+	c.maybeFinish()
+}
+
+func (c *Conn) processAck(h *header) {
+	var acked int
+	t := time.Now()
+
+	for len(c.outq) > 0 && !seqLess(h.ackNr, c.outq[0].seq) {
+		p := c.outq[0]
+		c.outq[0] = nil
+		c.outq = c.outq[1:]
+
+		if !p.needResend {
+			c.curWindow -= len(p.payload)
+		}
+		if p.transmissions == 1 {
+			c.updateRTT(t.Sub(p.sentAt))
+		}
+		if p.typ == stFin {
+			c.finAckedAt = t
+		}
+		acked += len(p.payload)
+		c.retransmits = 0
+	}
+
+	if acked > 0 {
+		c.dupAcks = 0
+		if h.timeDiff != 0 {
+			c.applyCongestionControl(h.timeDiff, acked)
+		}
+		notify(c.writeNotify)
+	} else if h.typ == stState && len(c.outq) > 0 && h.ackNr == c.lastAck {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			// fast retransmit of the packet the peer keeps asking for
+			c.maxWindow = math.Max(c.maxWindow/2, minWindow)
+			c.transmit(c.outq[0])
+		}
+	}
+	c.lastAck = h.ackNr
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+}
+
+// applyCongestionControl is the LEDBAT controller described in BEP 29.
+// delay is the one way delay of our packets as measured by the peer.
+func (c *Conn) applyCongestionControl(delay uint32, bytesAcked int) {
+	t := time.Now()
+	if t.Sub(c.baseDelayStart) > time.Minute {
+		c.baseDelayPrev = c.baseDelayCur
+		c.baseDelayCur = math.MaxUint32
+		c.baseDelayStart = t
+	}
+	if delay < c.baseDelayCur {
+		c.baseDelayCur = delay
+	}
+	base := c.baseDelayCur
+	if c.baseDelayPrev < base {
+		base = c.baseDelayPrev
+	}
+
+	ourDelay := float64(delay - base)
+	offTarget := (targetDelay - ourDelay) / targetDelay
+	windowFactor := float64(bytesAcked) / math.Max(c.maxWindow, float64(bytesAcked))
+	c.maxWindow += maxCwndIncreasePerRTT * offTarget * windowFactor
+
+	if c.maxWindow < minWindow {
+		c.maxWindow = minWindow
+	} else if c.maxWindow > maxWindowCap {
+		c.maxWindow = maxWindowCap
+	}
+}
+
+func (c *Conn) processData(h *header, payload []byte) {
+	if h.typ == stFin && !c.gotFin {
+		c.gotFin = true
+		c.eofSeq = h.seqNr
+	}
+
+	if h.typ == stData && seqLess(c.ackNr, h.seqNr) && h.seqNr-c.ackNr <= reorderLimit {
+		if _, ok := c.reorder[h.seqNr]; !ok {
+			b := make([]byte, len(payload))
+			copy(b, payload)
+			c.reorder[h.seqNr] = b
+		}
+	}
+
+	delivered := false
+	for {
+		next := c.ackNr + 1
+		if c.gotFin && next == c.eofSeq {
+			c.ackNr = next
+			c.readEOF = true
+			delivered = true
+			break
+		}
+		b, ok := c.reorder[next]
+		if !ok {
+			break
+		}
+		delete(c.reorder, next)
+		c.readBuf.Write(b)
+		c.ackNr = next
+		delivered = true
+	}
+
+	if delivered {
+		notify(c.readNotify)
+	}
+	c.sendState()
+}
+
+// flush resends lost packets and packetizes buffered data as far as the
+// congestion window and the peer's receive window allow.
+func (c *Conn) flush() {
+	if c.state != stateConnected {
+		if c.state == stateSynSent {
+			for _, p := range c.outq {
+				if p.needResend {
+					c.curWindow += len(p.payload)
+					c.transmit(p)
+				}
+			}
+		}
+		return
+	}
+
+	window := int(c.maxWindow)
+	if int(c.peerWnd) < window {
+		window = int(c.peerWnd)
+	}
+
+	for _, p := range c.outq {
+		if !p.needResend {
+			continue
+		}
+		if c.curWindow > 0 && c.curWindow+len(p.payload) > window {
+			return
+		}
+		c.curWindow += len(p.payload)
+		c.transmit(p)
+	}
+
+	for len(c.writeBuf) > 0 {
+		n := len(c.writeBuf)
+		if n > mss {
+			n = mss
+		}
+		if c.curWindow > 0 && c.curWindow+n > window {
+			return
+		}
+
+		payload := make([]byte, n)
+		copy(payload, c.writeBuf)
+		c.writeBuf = c.writeBuf[n:]
+		c.sendPacket(stData, payload)
+	}
+	if len(c.writeBuf) == 0 {
+		c.writeBuf = nil
+	}
+
+	if c.appClosed && !c.finSent {
+		c.finSent = true
+		c.sendPacket(stFin, nil)
+	}
+}
+
+// sendPacket queues a packet which consumes a sequence number and has to
+// be acknowledged, then sends it.
+func (c *Conn) sendPacket(typ byte, payload []byte) {
+	p := &outPacket{
+		typ:     typ,
+		seq:     c.seqNr,
+		payload: payload,
+	}
+	c.seqNr++
+	c.outq = append(c.outq, p)
+	c.curWindow += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	h := header{
+		typ:    p.typ,
+		connID: c.sendID,
+		seqNr:  p.seq,
+		ackNr:  c.ackNr,
+	}
+	// the SYN carries the id the initiator wants to receive on
+	if p.typ == stSyn {
+		h.connID = c.recvID
+	}
+
+	p.sentAt = time.Now()
+	p.transmissions++
+	p.needResend = false
+	c.write(&h, p.payload)
+}
+
+func (c *Conn) sendState() {
+	h := header{
+		typ:    stState,
+		connID: c.sendID,
+		seqNr:  c.seqNr,
+		ackNr:  c.ackNr,
+	}
+	c.write(&h, nil)
+}
+
+func (c *Conn) write(h *header, payload []byte) {
+	h.timestamp = now()
+	h.timeDiff = c.replyDiff
+	h.wndSize = c.recvWindowSize()
+	c.lastSend = time.Now()
+	c.sock.write(h.encode(payload), c.raddr)
+}
+
+func (c *Conn) recvWindowSize() uint32 {
+	n := recvWindow - c.readBuf.Len()
+	if n < 0 {
+		return 0
+	}
+	return uint32(n)
+}
+
+func (c *Conn) maybeFinish() {
+	if c.finSent && len(c.outq) == 0 && c.readEOF {
+		c.destroyLocked(nil)
+	}
+}
+
+func (c *Conn) destroyLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.err = err
+	close(c.done)
+	notify(c.readNotify)
+	notify(c.writeNotify)
+
+	c.sock.remove(c)
+	if c.ownSocket {
+		go c.sock.Close()
+	}
+}
+
+func (c *Conn) destroy(err error) {
+	c.mu.Lock()
+	c.destroyLocked(err)
+	c.mu.Unlock()
+}
+
+// abort resets the connection without waiting for outstanding data.
+func (c *Conn) abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	h := header{
+		typ:    stReset,
+		connID: c.sendID,
+		seqNr:  c.seqNr,
+		ackNr:  c.ackNr,
+	}
+	c.write(&h, nil)
+	c.destroyLocked(ErrSocketClosed)
+}
+
+func (c *Conn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-ch:
+	case <-c.done:
+	case <-timeout:
+		return ErrTimeout
+	}
+	return nil
+}
+
+// Read reads data from the connection. It returns io.EOF once the peer
+// has closed its side and every byte before its FIN has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.readBuf.Len() > 0 {
+			before := c.recvWindowSize()
+			n, _ := c.readBuf.Read(b)
+			if before < mss && c.recvWindowSize() >= mss && c.state == stateConnected {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.appClosed {
+			c.mu.Unlock()
+			return 0, errClosed
+		}
+		if c.readEOF {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write queues b for sending. It blocks while the send buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	var n int
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n < len(b) {
+		if c.appClosed {
+			return n, errClosed
+		}
+		if c.state == stateClosed {
+			if c.err != nil {
+				return n, c.err
+			}
+			return n, errClosed
+		}
+
+		space := sendBufferMax - len(c.writeBuf)
+		if space <= 0 {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			err := c.wait(c.writeNotify, deadline)
+			c.mu.Lock()
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		chunk := b[n:]
+		if len(chunk) > space {
+			chunk = chunk[:space]
+		}
+		c.writeBuf = append(c.writeBuf, chunk...)
+		n += len(chunk)
+		c.flush()
+	}
+	return n, nil
+}
+
+// Close sends a FIN once every buffered byte has been sent. The
+// connection lingers in the background until the FIN is acknowledged.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.appClosed {
+		return nil
+	}
+	c.appClosed = true
+	notify(c.readNotify)
+	notify(c.writeNotify)
+
+	switch c.state {
+	case stateSynSent:
+		c.destroyLocked(nil)
+	case stateConnected:
+		c.flush()
+		c.maybeFinish()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the underlying socket.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+// RemoteAddr returns the peer address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future and pending Read calls.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readNotify)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future and pending Write calls.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writeNotify)
+	return nil
+}
@@ -0,0 +1,108 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// packet types, http://www.bittorrent.org/beps/bep_0029.html#type
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+
+	version    = 1
+	headerSize = 20
+)
+
+var errShortPacket = errors.New("utp: packet too short")
+
+// header is the fixed 20 byte uTP packet header:
+//
+//	0       4       8               16              24              32
+//	+-------+-------+---------------+---------------+---------------+
+//	| type  | ver   | extension     | connection_id                 |
+//	+-------+-------+---------------+---------------+---------------+
+//	| timestamp_microseconds                                        |
+//	+---------------+---------------+---------------+---------------+
+//	| timestamp_difference_microseconds                             |
+//	+---------------+---------------+---------------+---------------+
+//	| wnd_size                                                      |
+//	+---------------+---------------+---------------+---------------+
+//	| seq_nr                        | ack_nr                        |
+//	+---------------+---------------+---------------+---------------+
+type header struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32
+	timeDiff  uint32
+	wndSize   uint32
+	seqNr     uint16
+	ackNr     uint16
+}
+
+// IsPacket reports whether b looks like a uTP packet. KRPC messages are
+// bencoded dictionaries and always start with 'd' (0x64), while the first
+// byte of a uTP packet is type<<4|version with version 1 and type 0-4,
+// so the two protocols can share one UDP port.
+func IsPacket(b []byte) bool {
+	if len(b) < headerSize {
+		return false
+	}
+	return b[0]&0x0f == version && b[0]>>4 <= stSyn
+}
+
+func (h *header) encode(payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	b[0] = h.typ<<4 | version
+	b[1] = 0
+	binary.BigEndian.PutUint16(b[2:4], h.connID)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timeDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(b[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(b[18:20], h.ackNr)
+	copy(b[headerSize:], payload)
+	return b
+}
+
+// decodePacket parses the header, skips over the extension chain and
+// returns the payload.
+func decodePacket(b []byte) (*header, []byte, error) {
+	if !IsPacket(b) {
+		return nil, nil, errShortPacket
+	}
+
+	h := &header{
+		typ:       b[0] >> 4,
+		connID:    binary.BigEndian.Uint16(b[2:4]),
+		timestamp: binary.BigEndian.Uint32(b[4:8]),
+		timeDiff:  binary.BigEndian.Uint32(b[8:12]),
+		wndSize:   binary.BigEndian.Uint32(b[12:16]),
+		seqNr:     binary.BigEndian.Uint16(b[16:18]),
+		ackNr:     binary.BigEndian.Uint16(b[18:20]),
+	}
+
+	ext := b[1]
+	off := headerSize
+	for ext != 0 {
+		if off+2 > len(b) {
+			return nil, nil, errShortPacket
+		}
+		ext = b[off]
+		length := int(b[off+1])
+		off += 2 + length
+		if off > len(b) {
+			return nil, nil, errShortPacket
+		}
+	}
+
+	return h, b[off:], nil
+}
+
+// seqLess compares two 16 bit sequence numbers taking wrap-around into account.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
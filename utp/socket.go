@@ -0,0 +1,304 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSocketClosed is returned by Accept and Dial once the socket is closed.
+	ErrSocketClosed = errors.New("utp: socket closed")
+	// ErrTimeout is returned when the remote end stops answering.
+	ErrTimeout = &timeoutError{}
+	// ErrReset is returned after the remote end reset the connection.
+	ErrReset = errors.New("utp: connection reset by peer")
+)
+
+type timeoutError struct{}
+
+func (*timeoutError) Error() string   { return "utp: i/o timeout" }
+func (*timeoutError) Timeout() bool   { return true }
+func (*timeoutError) Temporary() bool { return true }
+
+const acceptBacklog = 32
+
+type connKey struct {
+	addr   string
+	recvID uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket. A Socket
+// either owns its net.PacketConn and reads from it (NewSocket, Listen),
+// or shares a socket owned by someone else who feeds it packets through
+// HandlePacket (NewSharedSocket).
+type Socket struct {
+	pc    net.PacketConn
+	write func(b []byte, addr net.Addr) (int, error)
+	laddr net.Addr
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	rand   *rand.Rand
+	accept chan *Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewSocket creates a socket reading from and writing to pc.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := newSocket(pc.LocalAddr(), pc.WriteTo)
+	s.pc = pc
+	go s.readLoop()
+	return s
+}
+
+// NewSharedSocket creates a socket which sends packets with write and
+// receives them only through HandlePacket. Use it to run uTP on a port
+// already read by another protocol such as the DHT.
+func NewSharedSocket(laddr net.Addr, write func(b []byte, addr net.Addr) (int, error)) *Socket {
+	return newSocket(laddr, write)
+}
+
+// Listen announces on the local UDP address.
+func Listen(network, address string) (*Socket, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+func newSocket(laddr net.Addr, write func(b []byte, addr net.Addr) (int, error)) *Socket {
+	return &Socket{
+		write:  write,
+		laddr:  laddr,
+		conns:  make(map[connKey]*Conn),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		s.HandlePacket(buf[:n], addr)
+	}
+}
+
+// HandlePacket processes an incoming datagram. It reports false when b
+// is not a uTP packet so that the caller can hand it to somebody else.
+// b is not retained.
+func (s *Socket) HandlePacket(b []byte, addr net.Addr) bool {
+	h, payload, err := decodePacket(b)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	c, ok := s.conns[connKey{addr.String(), h.connID}]
+	s.mu.Unlock()
+
+	if ok {
+		c.handlePacket(h, payload)
+		return true
+	}
+
+	switch h.typ {
+	case stSyn:
+		s.handleSyn(h, addr)
+	case stReset:
+	default:
+		s.sendReset(h, addr)
+	}
+	return true
+}
+
+func (s *Socket) handleSyn(h *header, addr net.Addr) {
+	select {
+	case <-s.closed:
+		s.sendReset(h, addr)
+		return
+	default:
+	}
+
+	s.mu.Lock()
+	key := connKey{addr.String(), h.connID + 1}
+	if c, ok := s.conns[key]; ok {
+		// our STATE got lost and the SYN was retransmitted
+		s.mu.Unlock()
+		c.mu.Lock()
+		c.sendState()
+		c.mu.Unlock()
+		return
+	}
+	c := newConn(s, addr, h.connID+1, h.connID, uint16(s.rand.Intn(65536)))
+	c.ackNr = h.seqNr
+	c.state = stateConnected
+	c.peerWnd = h.wndSize
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- c:
+		c.mu.Lock()
+		c.sendState()
+		c.mu.Unlock()
+		go c.loop()
+	default:
+		s.remove(c)
+		s.sendReset(h, addr)
+	}
+}
+
+func (s *Socket) sendReset(h *header, addr net.Addr) {
+	r := header{
+		typ:       stReset,
+		connID:    h.connID,
+		timestamp: now(),
+		ackNr:     h.seqNr,
+	}
+	s.write(r.encode(nil), addr)
+}
+
+// Dial opens a connection to the uTP peer at address.
+func (s *Socket) Dial(address string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialContext opens a connection to addr, giving up when ctx is done or
+// the SYN is not answered after a few retransmits.
+func (s *Socket) DialContext(ctx context.Context, addr net.Addr) (*Conn, error) {
+	select {
+	case <-s.closed:
+		return nil, ErrSocketClosed
+	default:
+	}
+
+	s.mu.Lock()
+	var recvID uint16
+	for {
+		recvID = uint16(s.rand.Intn(65536))
+		if _, ok := s.conns[connKey{addr.String(), recvID}]; !ok {
+			break
+		}
+	}
+	c := newConn(s, addr, recvID, recvID+1, 1)
+	s.conns[connKey{addr.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.sendPacket(stSyn, nil)
+	c.mu.Unlock()
+	go c.loop()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		c.destroy(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// Accept waits for and returns the next incoming connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, ErrSocketClosed
+	}
+}
+
+// Addr returns the local address of the socket.
+func (s *Socket) Addr() net.Addr {
+	return s.laddr
+}
+
+// Close resets every open connection and, if the socket owns its
+// net.PacketConn, closes it.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.abort()
+		}
+		if s.pc != nil {
+			err = s.pc.Close()
+		}
+	})
+	return err
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+	s.mu.Unlock()
+}
+
+// Dial opens a connection to address over a private socket bound to an
+// ephemeral port; the socket is closed together with the connection.
+func Dial(network, address string, timeout time.Duration) (*Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return DialContext(ctx, network, address)
+}
+
+// DialContext is like Dial but gives up when ctx is done.
+func DialContext(ctx context.Context, network, address string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewSocket(pc)
+	c, err := s.DialContext(ctx, raddr)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	c.ownSocket = true
+	return c, nil
+}
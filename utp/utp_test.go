@@ -0,0 +1,114 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsPacket(t *testing.T) {
+	h := header{typ: stSyn, connID: 1234, seqNr: 1}
+	if !IsPacket(h.encode(nil)) {
+		t.Error("SYN packet was not recognised")
+	}
+
+	krpc := []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")
+	if IsPacket(krpc) {
+		t.Error("KRPC message was taken for a uTP packet")
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	server, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(data)
+		c.Close()
+	}()
+
+	c, err := Dial("udp", server.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, expected %d identical bytes", len(got), len(data))
+	}
+}
+
+// lossyConn drops every tenth outgoing packet to exercise retransmits.
+type lossyConn struct {
+	net.PacketConn
+	n int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.n++
+	if c.n%10 == 0 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewSocket(&lossyConn{PacketConn: pc})
+	defer server.Close()
+
+	client, err := Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := make([]byte, 128*1024)
+	rand.Read(data)
+
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(data)
+		c.Close()
+	}()
+
+	c, err := client.Dial(server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(60 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data corrupted")
+	}
+}
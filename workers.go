@@ -0,0 +1,158 @@
+package dht
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPacketSize is the size of the receive buffers. KRPC messages fit
+// in a single datagram, well below it.
+const maxPacketSize = 8192
+
+// DropPolicy decides what happens to a received packet when the handler
+// queue is full.
+type DropPolicy int
+
+const (
+	// DropNewest drops the packet that just arrived.
+	DropNewest DropPolicy = iota
+	// DropOldest drops the packet that waited the longest in the queue
+	// to make room for the new one.
+	DropOldest
+	// Block stops reading from the socket until a worker is free, the
+	// kernel drops packets once its receive buffer is full.
+	Block
+)
+
+// WorkerPool configures the handlers of received packets, see
+// OptionWorkerPool.
+type WorkerPool struct {
+	// Workers is the number of packets handled concurrently, 4 per CPU
+	// if zero.
+	Workers int
+	// QueueSize is the number of received packets waiting for a worker,
+	// 1024 if zero.
+	QueueSize int
+	// Policy applies when the queue is full.
+	Policy DropPolicy
+}
+
+// WorkerStats reports the state of the handler queue.
+type WorkerStats struct {
+	// QueueDepth is the number of packets waiting for a worker.
+	QueueDepth int
+	// Handled and Dropped count the packets since the node started.
+	Handled uint64
+	Dropped uint64
+}
+
+type packet struct {
+	buf  *[]byte
+	n    int
+	addr *net.UDPAddr
+	// conn is the socket the packet arrived on, replies are sent from it
+	conn net.PacketConn
+}
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, maxPacketSize)
+		return &b
+	},
+}
+
+type workerPool struct {
+	handled, dropped uint64
+
+	config WorkerPool
+	queue  chan packet
+}
+
+func newWorkerPool(config WorkerPool) *workerPool {
+	if config.Workers <= 0 {
+		config.Workers = 4 * runtime.NumCPU()
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1024
+	}
+	return &workerPool{
+		config: config,
+		queue:  make(chan packet, config.QueueSize),
+	}
+}
+
+func (p *workerPool) drop(pkt packet) {
+	atomic.AddUint64(&p.dropped, 1)
+	packetPool.Put(pkt.buf)
+}
+
+// push queues pkt according to the drop policy. It only blocks with the
+// Block policy, until a worker is free or closed is closed.
+func (p *workerPool) push(pkt packet, closed <-chan struct{}) {
+	switch p.config.Policy {
+	case Block:
+		select {
+		case p.queue <- pkt:
+		case <-closed:
+			p.drop(pkt)
+		}
+	case DropOldest:
+		for {
+			select {
+			case p.queue <- pkt:
+				return
+			default:
+			}
+			select {
+			case old := <-p.queue:
+				p.drop(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case p.queue <- pkt:
+		default:
+			p.drop(pkt)
+		}
+	}
+}
+
+func (p *workerPool) stats() WorkerStats {
+	return WorkerStats{
+		QueueDepth: len(p.queue),
+		Handled:    atomic.LoadUint64(&p.handled),
+		Dropped:    atomic.LoadUint64(&p.dropped),
+	}
+}
+
+// startWorkers runs the packet handlers until the node is closed.
+func (node *Node) startWorkers() {
+	p := node.workers
+	for i := 0; i < p.config.Workers; i++ {
+		node.handlers.Add(1)
+		go func() {
+			defer node.handlers.Done()
+			for {
+				select {
+				case pkt := <-p.queue:
+					// handleKRPCMsg must not keep references to the
+					// buffer, it is reused as soon as it returns
+					node.handleKRPCMsg(pkt.conn, pkt.addr, (*pkt.buf)[:pkt.n])
+					packetPool.Put(pkt.buf)
+					atomic.AddUint64(&p.handled, 1)
+				case <-node.closed:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// WorkerStats returns the depth of the handler queue and the number of
+// packets handled and dropped.
+func (node *Node) WorkerStats() WorkerStats {
+	return node.workers.stats()
+}
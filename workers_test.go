@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"testing"
+)
+
+func pushN(p *workerPool, n int) {
+	closed := make(chan struct{})
+	for i := 0; i < n; i++ {
+		buf := packetPool.Get().(*[]byte)
+		p.push(packet{buf: buf, n: i}, closed)
+	}
+}
+
+func TestWorkerPoolDropPolicy(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		queued []int
+	}{
+		{DropNewest, []int{0, 1}},
+		{DropOldest, []int{2, 3}},
+	}
+
+	for _, test := range tests {
+		p := newWorkerPool(WorkerPool{Workers: 1, QueueSize: 2, Policy: test.policy})
+		pushN(p, 4)
+
+		stats := p.stats()
+		if stats.QueueDepth != 2 || stats.Dropped != 2 {
+			t.Errorf("policy %d: got %+v, want 2 queued and 2 dropped", test.policy, stats)
+		}
+		for _, want := range test.queued {
+			if pkt := <-p.queue; pkt.n != want {
+				t.Errorf("policy %d: packet %d queued, want %d", test.policy, pkt.n, want)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolBlock(t *testing.T) {
+	p := newWorkerPool(WorkerPool{Workers: 1, QueueSize: 1, Policy: Block})
+	closed := make(chan struct{})
+
+	p.push(packet{buf: packetPool.Get().(*[]byte)}, closed)
+	done := make(chan struct{})
+	go func() {
+		p.push(packet{buf: packetPool.Get().(*[]byte)}, closed)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("push did not block on a full queue")
+	default:
+	}
+	<-p.queue
+	<-done
+
+	if stats := p.stats(); stats.Dropped != 0 || stats.QueueDepth != 1 {
+		t.Errorf("got %+v, want 1 queued and none dropped", stats)
+	}
+}